@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"mime"
 	"os"
 	"path"
 	"strings"
@@ -13,7 +14,34 @@ import (
 const diffsDir string = "diffs"
 const listingFile string = "listing.json"
 
-// Archive encapsulates an unzipped POST zip archive
+var errMissingContent = errors.New("Listing does not match diffs/ in archive.")
+
+// Payload formats understood by Archive.Decompress()
+const (
+	FormatZip   = "zip"
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+)
+
+// PayloadFormat maps the Content-Type of a POST payload to one of the
+// formats above. Anything we don't recognise is assumed to be a zip archive,
+// which is what older clients send (usually without a Content-Type at all).
+func PayloadFormat(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return FormatZip
+	}
+	switch t {
+	case "application/gzip", "application/x-gzip", "application/x-gtar",
+		"application/x-tgz":
+		return FormatTarGz
+	case "application/x-tar", "application/tar":
+		return FormatTar
+	}
+	return FormatZip
+}
+
+// Archive encapsulates an extracted POST archive (zip or tarball)
 type Archive struct {
 	tempDir string
 	listing map[string]string // name => SHA-256 hash (from the client)
@@ -25,6 +53,7 @@ type ArchiveComparison struct {
 	added   []string
 	changed []string
 	removed []string
+	ignored []string // names in the listing that we won't store
 }
 
 // Lazily loads and parses the listing file
@@ -85,11 +114,22 @@ func (a *Archive) GetMetadata() (b []byte, err error) {
 	return b, nil
 }
 
+// GetIgnoreFile returns the contents of this app's .siphonignore if it was
+// sent in the archive, or nil if it was not (i.e. it did not change).
+func (a *Archive) GetIgnoreFile() (b []byte, err error) {
+	if !a.diffExists(IgnoreFileName) {
+		return nil, nil
+	}
+	return a.GetContent(IgnoreFileName)
+}
+
 // Compare does a comparison of each name->hash in `files` to our internal
 // listing and returns new/changed files that need writing and removed files
-// that need deleting.
-func (a *Archive) Compare(files map[string]string) (
-	comparison *ArchiveComparison, err error) {
+// that need deleting. Any names matched by `ignore` (which may be nil) are
+// never written, and are removed if we already have them. The `shared`
+// hashes are stored by other apps, so their content may also be omitted.
+func (a *Archive) Compare(files map[string]string, ignore *IgnoreRules,
+	shared map[string]bool) (comparison *ArchiveComparison, err error) {
 	err = a.parseListingFile() // lazy
 	if err != nil {
 		return nil, err
@@ -98,11 +138,16 @@ func (a *Archive) Compare(files map[string]string) (
 	added := []string{}
 	changed := []string{}
 	removed := []string{}
+	ignored := []string{}
 
 	// Compute additions (paths that exist in listing but not in our current
 	// hashes) and changes (paths in the listing that we do have, but the SHA
 	// is different)
 	for name, sha := range a.listing {
+		if ignore != nil && ignore.Ignored(name) {
+			ignored = append(ignored, name)
+			continue
+		}
 		serverSha, ok := files[name]
 		if !ok {
 			added = append(added, name)
@@ -111,28 +156,39 @@ func (a *Archive) Compare(files map[string]string) (
 		}
 	}
 
-	// Verify that a file in /diffs exists for each of our additions/changes
+	// Verify that a file in /diffs exists for each of our additions/changes,
+	// unless we already have a file with the same hash (e.g. the file was
+	// renamed or copied), in which case the client may omit the content.
+	stored := map[string]bool{}
+	for _, sha := range files {
+		stored[sha] = true
+	}
 	for _, name := range append(added, changed...) {
-		if !a.diffExists(name) {
+		sha := a.listing[name]
+		if !a.diffExists(name) && !stored[sha] && !shared[sha] {
 			log.Printf("Could not find %s in diffs/ dir.", name)
-			return nil, errors.New("Listing does not match diffs/ in archive.")
+			return nil, errMissingContent
 		}
 	}
 
-	// Removals (path that exist in our current hashes, but not in the listing)
+	// Removals (path that exist in our current hashes, but not in the
+	// listing, or that are now ignored)
 	for name := range files {
 		_, ok := a.listing[name]
-		if !ok {
+		if !ok || (ignore != nil && ignore.Ignored(name)) {
 			removed = append(removed, name)
 		}
 	}
 
-	return &ArchiveComparison{added, changed, removed}, nil
+	return &ArchiveComparison{added, changed, removed, ignored}, nil
 }
 
 // GetHash returns a SHA-256 for a file name that should exist in this
 // archive, or "" if no hash could be found.
 func (a *Archive) GetHash(name string) string {
+	if err := a.parseListingFile(); err != nil { // lazy
+		return ""
+	}
 	h, ok := a.listing[name]
 	if !ok {
 		return ""
@@ -140,6 +196,24 @@ func (a *Archive) GetHash(name string) string {
 	return h
 }
 
+// ListingHashes returns every hash in the client's listing.
+func (a *Archive) ListingHashes() ([]string, error) {
+	if err := a.parseListingFile(); err != nil { // lazy
+		return nil, err
+	}
+	hashes := []string{}
+	for _, sha := range a.listing {
+		hashes = append(hashes, sha)
+	}
+	return hashes, nil
+}
+
+// HasContent returns true if the client sent the content for the given name
+// in /diffs (see Compare() for when it may be omitted).
+func (a *Archive) HasContent(name string) bool {
+	return a.diffExists(name)
+}
+
 // GetContent returns the raw file content from /diffs for the given name.
 func (a *Archive) GetContent(name string) (b []byte, err error) {
 	p := a.diffPath(name)
@@ -150,9 +224,12 @@ func (a *Archive) GetContent(name string) (b []byte, err error) {
 	return b, nil
 }
 
-// Decompress takes a zip archive sent as a POST payload and unzips it
-// for further processing.
-func (a *Archive) Decompress(b []byte) error {
+// Decompress takes an archive sent as a POST payload and extracts it
+// for further processing. The `format` should be one of FormatZip, FormatTar
+// or FormatTarGz (see PayloadFormat()). If an entry breaks the extraction
+// `policy` then an *ExtractError is returned, which is safe to show the user.
+func (a *Archive) Decompress(b []byte, format string,
+	policy *ExtractPolicy) error {
 	// Create the temporary dir
 	d, err := ioutil.TempDir("", "bundler-archive")
 	if err != nil {
@@ -160,14 +237,24 @@ func (a *Archive) Decompress(b []byte) error {
 		return errors.New("Failed to decompress the payload.")
 	}
 	a.tempDir = d
-	// Write out the zip archive there
-	src := path.Join(a.tempDir, "archive.zip")
+	// Write out the archive there
+	src := path.Join(a.tempDir, "archive."+format)
 	err = ioutil.WriteFile(src, b, 0600)
 
-	// Unzip it into the temp directory
-	err = Unzip(src, a.tempDir)
-	if err != nil {
-		log.Printf("Failed to extract zip archive: %v", err)
+	// Extract it into the temp directory
+	switch format {
+	case FormatTar:
+		err = Untar(src, a.tempDir, false, policy)
+	case FormatTarGz:
+		err = Untar(src, a.tempDir, true, policy)
+	default:
+		err = Unzip(src, a.tempDir, policy)
+	}
+	if e, ok := err.(*ExtractError); ok {
+		log.Printf("Rejected %s archive: %v", format, e)
+		return e
+	} else if err != nil {
+		log.Printf("Failed to extract %s archive: %v", format, err)
 		return errors.New("Failed to decompress the payload.")
 	}
 	return nil
@@ -0,0 +1,153 @@
+package bundler
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// Actions recorded in the audit log. These are all of the operations that
+// change an app in this service: there is no rollback or app deletion
+// here, and files are only ever removed by a push (see AuditFiles.Removed).
+const (
+	AuditPush          = "push"
+	AuditSubmit        = "submit"
+	AuditWebhookAdd    = "webhook_add"
+	AuditWebhookDelete = "webhook_delete"
+)
+
+// Outcomes recorded in the audit log
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+const defaultAuditLimit = 50
+const maxAuditLimit = 500
+
+// AuditFiles lists the file names affected by an audited operation.
+type AuditFiles struct {
+	Added   []string `json:"added,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// AuditEntry is a single row of the append-only audit log.
+type AuditEntry struct {
+	ID           int64      `json:"id"`
+	Created      time.Time  `json:"created"`
+	Action       string     `json:"action"`
+	AppID        string     `json:"app_id"`
+	SubmissionID string     `json:"submission_id"`
+	UserID       string     `json:"user_id"`
+	SourceIP     string     `json:"source_ip"`
+	Files        AuditFiles `json:"files"`
+	Outcome      string     `json:"outcome"`
+	Message      string     `json:"message"`
+}
+
+// AuditQuery filters the audit log. Zero values match anything.
+type AuditQuery struct {
+	UserID   string
+	From     time.Time
+	To       time.Time
+	BeforeID int64 // for pagination, see AuditResponse.Next
+}
+
+// AuditResponse is a page of the audit log. Pass `Next` as the "before"
+// parameter to get the next (older) page; it is zero on the last page.
+type AuditResponse struct {
+	Entries []*AuditEntry `json:"entries"`
+	Next    int64         `json:"next,omitempty"`
+}
+
+// sourceIP returns the IP address the request came from.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RecordAudit fills in the request details (user ID from the handshake and
+// source IP) and appends the entry to the audit log. It fails silently
+// (apart from logging) so it never interrupts the operation itself.
+func RecordAudit(r *http.Request, e *AuditEntry) {
+	if userID, ok := context.Get(r, UserIDKey).(string); ok {
+		e.UserID = userID
+	}
+	e.SourceIP = sourceIP(r)
+	db := OpenDB()
+	defer db.Close()
+	if err := AddAuditEntry(db, e); err != nil {
+		log.Printf("(ignored) Failed to record %s audit entry for %s: %v",
+			e.Action, e.AppID, err)
+	}
+}
+
+// parseAuditQuery reads the "user_id", "from", "to" (RFC 3339), "before"
+// and "limit" parameters.
+func parseAuditQuery(r *http.Request) (q *AuditQuery, limit int,
+	errMsg string) {
+	q = &AuditQuery{UserID: r.FormValue("user_id")}
+	var err error
+	if s := r.FormValue("from"); s != "" {
+		if q.From, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, 0, "Invalid 'from' time, expected RFC 3339."
+		}
+	}
+	if s := r.FormValue("to"); s != "" {
+		if q.To, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, 0, "Invalid 'to' time, expected RFC 3339."
+		}
+	}
+	if s := r.FormValue("before"); s != "" {
+		if q.BeforeID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, 0, "Invalid 'before' parameter."
+		}
+	}
+	limit = defaultAuditLimit
+	if s := r.FormValue("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			return nil, 0, "Invalid 'limit' parameter."
+		}
+	}
+	return q, limit, ""
+}
+
+// AuditLog handles a response for the /audit/{app_id}/ route, returning a
+// page of the app's audit log (newest first).
+func AuditLog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := context.GetOk(r, UserIDKey); !ok {
+		http.Error(w, "The audit log requires a development handshake.",
+			http.StatusUnauthorized)
+		return
+	}
+	appID := context.Get(r, AppIDKey).(string)
+	q, limit, errMsg := parseAuditQuery(r)
+	if errMsg != "" {
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	db := OpenDB()
+	defer db.Close()
+	// Fetch one extra entry so we know if there's another page
+	entries, err := GetAuditEntries(db, appID, q, limit+1)
+	if err != nil {
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	resp := AuditResponse{Entries: entries}
+	if len(entries) > limit {
+		resp.Entries = entries[:limit]
+		resp.Next = resp.Entries[limit-1].ID
+	}
+	writeJSON(w, resp, http.StatusOK)
+}
@@ -25,6 +25,7 @@ const UserIDKey int = 1001
 const SubmissionIDKey int = 1002
 const HandshakeTokenKey int = 1003
 const HandshakeSignatureKey int = 1004
+const SubmitterIDKey int = 1005
 
 type handshake struct {
 	Action       string `json:"action"`
@@ -104,7 +105,8 @@ func AuthMiddleware(h http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// Verify the "action" matches the endpoint.
-		validActions := []string{"push", "pull", "submit"}
+		validActions := []string{"push", "pull", "submit", "clone",
+			"webhooks", "audit", "events"}
 		foundAction := false
 		for _, action := range validActions {
 			if obj.Action == action {
@@ -125,14 +127,13 @@ func AuthMiddleware(h http.HandlerFunc) http.HandlerFunc {
 		}
 
 		if obj.SubmissionID != "" {
-			// This is a production handshake, the user_id should not be
-			// set in the handshake.
+			// This is a production handshake. It may say which user asked
+			// for it (for the audit log), but that user ID is kept apart
+			// from UserIDKey so it grants no development access.
+			context.Set(r, SubmissionIDKey, obj.SubmissionID)
 			if obj.UserID != "" {
-				http.Error(w, "Malformed handshake_token.",
-					http.StatusUnauthorized)
-				return
+				context.Set(r, SubmitterIDKey, obj.UserID)
 			}
-			context.Set(r, SubmissionIDKey, obj.SubmissionID)
 		} else {
 			// Otherwise assume this is a development handshake, in which case
 			// the "user_id" should be set.
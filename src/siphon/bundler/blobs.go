@@ -0,0 +1,137 @@
+package bundler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/context"
+)
+
+// BlobDedupEnabled returns true if blobs may be shared between apps, so that
+// pushing content that any app already stores costs no upload. It is off
+// unless BLOB_DEDUP is set, because it lets a client that knows a hash
+// obtain that content from another app.
+func BlobDedupEnabled() bool {
+	b, _ := strconv.ParseBool(os.Getenv("BLOB_DEDUP"))
+	return b
+}
+
+// sharedHashes returns the subset of `hashes` that this app does not store
+// but which another app does (if dedup is enabled), so that the client may
+// omit their content.
+func sharedHashes(db *sql.DB, appID string, hashes []string) (
+	shared map[string]bool, err error) {
+	if !BlobDedupEnabled() {
+		return map[string]bool{}, nil
+	}
+	own, err := GetStoredHashes(db, appID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	others := []string{}
+	for _, hash := range hashes {
+		if !own[hash] {
+			others = append(others, hash)
+		}
+	}
+	return GetStoredHashes(db, "", others)
+}
+
+// sharedBlob reads a blob stored by another app.
+func sharedBlob(db *sql.DB, hash string) ([]byte, error) {
+	owner, err := FindHashOwner(db, hash)
+	if err != nil {
+		return nil, err
+	} else if owner == "" {
+		log.Printf("[sharedBlob() no owner] hash=%s", hash)
+		return nil, errMissingContent
+	}
+	src, err := NewCache(owner, "")
+	if err != nil {
+		return nil, err
+	}
+	return src.Get(hash)
+}
+
+// copySharedBlob copies a blob stored by another app into `cache`.
+func copySharedBlob(db *sql.DB, cache *Cache, hash string) error {
+	b, err := sharedBlob(db, hash)
+	if err != nil {
+		return err
+	}
+	return cache.Set(hash, b)
+}
+
+// The most hashes we'll look up in one request
+const maxMissingBlobsHashes = 10000
+
+// MissingBlobsRequest is the payload for POST /v1/push/{app_id}/missing/
+type MissingBlobsRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+// MissingBlobsResponse lists the hashes whose content the client must send
+// when it pushes.
+type MissingBlobsResponse struct {
+	Missing []string `json:"missing"`
+	Dedup   bool     `json:"dedup"` // true if we checked every app
+}
+
+// MissingBlobs handles a response for the /push/{app_id}/missing/ route,
+// which tells the client which of the given SHA-256 hashes we don't store
+// for this app (or for any app, if dedup is enabled).
+func MissingBlobs(w http.ResponseWriter, r *http.Request) {
+	appID := context.Get(r, AppIDKey).(string)
+
+	b, err := ioutil.ReadAll(r.Body)
+	var req MissingBlobsRequest
+	if err == nil {
+		err = json.Unmarshal(b, &req)
+	}
+	if err != nil || req.Hashes == nil {
+		log.Printf("Error decoding /missing JSON: %v", err)
+		http.Error(w, "Malformed payload.", http.StatusBadRequest)
+		return
+	} else if len(req.Hashes) > maxMissingBlobsHashes {
+		http.Error(w, fmt.Sprintf("At most %d hashes may be checked at once.",
+			maxMissingBlobsHashes), http.StatusBadRequest)
+		return
+	}
+
+	db := OpenDB()
+	defer db.Close()
+
+	lookupAppID := appID
+	if BlobDedupEnabled() {
+		lookupAppID = "" // any app
+	}
+	stored, err := GetStoredHashes(db, lookupAppID, req.Hashes)
+	if err != nil {
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	resp := MissingBlobsResponse{Missing: []string{},
+		Dedup: lookupAppID == ""}
+	seen := map[string]bool{}
+	for _, hash := range req.Hashes {
+		if !stored[hash] && !seen[hash] {
+			resp.Missing = append(resp.Missing, hash)
+		}
+		seen[hash] = true
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to serialize missing blobs: %v", err)
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -1,6 +1,9 @@
 package bundler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -19,10 +22,9 @@ type Cache struct {
 	s3           *S3Wrapper
 }
 
-// BundleFooterFile returns the key for a bundle footer for a given platform
-func BundleFooterFile(platform string) string {
-	return fmt.Sprintf("bundle-footer-%s", platform)
-}
+// How many previous versions of each bundle footer we keep around to send
+// deltas against.
+const footerHistoryLength = 5
 
 // NewCache wraps memcache and S3. It uses `appID` and `submissionID` to
 // prefix it's keys internally. An empty `submissionID` means we're dealing
@@ -87,8 +89,77 @@ func (c *Cache) GetBundleFooter(name string) (b []byte, err error) {
 	return c.Get(name)
 }
 
+// SetBundleFooter stores the footer under `name`, and also keeps a copy keyed
+// by its hash so that pulls can send deltas against it later on.
 func (c *Cache) SetBundleFooter(b []byte, name string) error {
-	return c.Set(name, b)
+	if err := c.Set(name, b); err != nil {
+		return err
+	}
+	return c.addFooterVersion(name, b)
+}
+
+// FooterHash returns the hash that clients use to identify a bundle footer.
+func FooterHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func footerVersionKey(name string, hash string) string {
+	return fmt.Sprintf("%s-versions/%s", name, hash)
+}
+
+// footerHistory returns the hashes of the recent versions of a footer, most
+// recent first. A missing history is just empty.
+func (c *Cache) footerHistory(name string) []string {
+	b, err := c.Get(name + "-history")
+	if err != nil {
+		return []string{}
+	}
+	var hashes []string
+	if err := json.Unmarshal(b, &hashes); err != nil {
+		log.Printf("(Ignored) footerHistory() unmarshal error: %v", err)
+		return []string{}
+	}
+	return hashes
+}
+
+func (c *Cache) addFooterVersion(name string, b []byte) error {
+	hash := FooterHash(b)
+	if err := c.Set(footerVersionKey(name, hash), b); err != nil {
+		return err
+	}
+	hashes := []string{hash}
+	for _, h := range c.footerHistory(name) {
+		if h == hash {
+			continue
+		} else if len(hashes) < footerHistoryLength {
+			hashes = append(hashes, h)
+		} else if err := c.Delete(footerVersionKey(name, h)); err != nil {
+			log.Printf("(Ignored) addFooterVersion() delete error: %v", err)
+		}
+	}
+	j, err := json.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	return c.Set(name+"-history", j)
+}
+
+// GetFooterVersion returns a recent version of a footer by its hash, or nil
+// if we no longer have it.
+func (c *Cache) GetFooterVersion(name string, hash string) []byte {
+	for _, h := range c.footerHistory(name) {
+		if h != hash {
+			continue
+		}
+		b, err := c.Get(footerVersionKey(name, hash))
+		if err != nil {
+			log.Printf("(Ignored) GetFooterVersion() error: %v", err)
+			return nil
+		}
+		return b
+	}
+	return nil
 }
 
 // Set writes the key to S3 and memcache.
@@ -110,6 +181,24 @@ func (c *Cache) Set(key string, b []byte) error {
 	return nil
 }
 
+// GetStored gets a key straight from S3, bypassing memcache. It's for big
+// objects (like cached pull responses) that memcache may not take and that
+// would otherwise push out the files it's there for.
+func (c *Cache) GetStored(key string) (b []byte, err error) {
+	return c.s3.GetKey(c.prefixed(key))
+}
+
+// SetStored writes a key to S3 only, see GetStored().
+func (c *Cache) SetStored(key string, b []byte) error {
+	k := c.prefixed(key)
+	log.Printf("[cache-set-stored %s]", k)
+	if err := c.s3.WriteKey(k, b); err != nil {
+		log.Printf("[Cache.SetStored() S3 error] %v", err)
+		return err
+	}
+	return nil
+}
+
 // Delete removes the key in both S3 and memcache.
 func (c *Cache) Delete(key string) error {
 	k := c.prefixed(key)
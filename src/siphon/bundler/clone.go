@@ -0,0 +1,79 @@
+package bundler
+
+import (
+	"archive/zip"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/context"
+)
+
+// writeSourceZip writes every one of the given files (name -> SHA-256 hash)
+// into a zip archive, using the stored names as paths.
+func writeSourceZip(w http.ResponseWriter, files map[string]string,
+	cache *Cache) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/zip")
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+	for _, name := range names {
+		b, err := cache.Get(files[name])
+		if err != nil {
+			return err
+		}
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clone handles a response for the /clone route, which returns an app's
+// full source tree (including its Siphonfile) as a zip archive. If a
+// "submission_id" parameter is given, the submission's files are returned
+// instead of the development files.
+func Clone(w http.ResponseWriter, r *http.Request) {
+	// As with /pull, a submission ID must match the one in the handshake.
+	submissionID := r.FormValue("submission_id")
+	if submissionID != "" && submissionID != context.Get(r, SubmissionIDKey) {
+		http.Error(w, "Submission ID does not match the handshake.",
+			http.StatusUnauthorized)
+		return
+	}
+	appID := context.Get(r, AppIDKey).(string)
+
+	db := OpenDB()
+	defer db.Close()
+
+	files, err := GetFiles(db, appID, submissionID)
+	if err != nil {
+		log.Printf("Clone() GetFiles error: %v", err)
+		http.Error(w, "Internal error.", 500)
+		return
+	} else if len(files) < 1 {
+		http.Error(w, errAppEmpty.Error(), 400)
+		return
+	}
+
+	cache, err := NewCache(appID, submissionID)
+	if err != nil {
+		log.Printf("Clone() NewCache error: %v", err)
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	if err := writeSourceZip(w, files, cache); err != nil {
+		// The zip has already started streaming, so all we can do is log
+		// it (the client will see a truncated archive).
+		log.Printf("Clone() writeSourceZip error: %v", err)
+	}
+}
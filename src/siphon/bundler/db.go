@@ -2,26 +2,41 @@ package bundler
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
-	// Loads the PostgreSQL driver for database/sql.
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const filesTable = "files"
+const revisionsTable = "revisions"
+const webhooksTable = "webhooks"
+const webhookDeliveriesTable = "webhook_deliveries"
+const auditTable = "audit_log"
+const submitJobsTable = "submit_jobs"
+const appEventsTable = "app_events"
+const pullCacheTable = "pull_cache"
 
-// OpenDB returns a configured connection to the postgres database.
-func OpenDB() *sql.DB {
-	url := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable",
+// Postgres error code for a unique constraint violation
+const pqUniqueViolation = "23505"
+
+// dbURL returns the connection string for the postgres database.
+func dbURL() string {
+	return fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable",
 		os.Getenv("POSTGRES_BUNDLER_ENV_POSTGRES_USER"),
 		os.Getenv("POSTGRES_BUNDLER_ENV_POSTGRES_PASSWORD"),
 		os.Getenv("POSTGRES_BUNDLER_PORT_5432_TCP_ADDR"),
 		os.Getenv("POSTGRES_BUNDLER_ENV_POSTGRES_DB"))
-	db, err := sql.Open("postgres", url)
+}
+
+// OpenDB returns a configured connection to the postgres database.
+func OpenDB() *sql.DB {
+	db, err := sql.Open("postgres", dbURL())
 	if err != nil {
 		log.Fatalf("Error opening DB connection: %v", err)
 	}
@@ -184,6 +199,61 @@ func GetSliceFilteredFiles(db *sql.DB, appID string, submissionID string,
 	return files, nil
 }
 
+// GetStoredHashes returns the subset of `hashes` that are referenced by
+// development files of the given app, or of any app if `appID` is empty.
+func GetStoredHashes(db *sql.DB, appID string, hashes []string) (
+	stored map[string]bool, err error) {
+	stored = map[string]bool{}
+	if len(hashes) == 0 {
+		return stored, nil
+	}
+	// Note: postgres-specific query
+	args := []interface{}{}
+	sqlVars := []string{}
+	for _, hash := range hashes {
+		args = append(args, hash)
+		sqlVars = append(sqlVars, fmt.Sprintf("$%d", len(args)))
+	}
+	query := fmt.Sprintf("SELECT DISTINCT hash FROM %s WHERE %s AND "+
+		"hash = ANY(ARRAY[%s])", filesTable, subClause(""),
+		strings.Join(sqlVars, ", "))
+	if appID != "" {
+		args = append(args, appID)
+		query += fmt.Sprintf(" AND app_id = $%d", len(args))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("GetStoredHashes() query error: %v", err)
+		return nil, errors.New("Failed to look up stored hashes.")
+	}
+	defer rows.Close()
+	var hash string
+	for rows.Next() {
+		if err := rows.Scan(&hash); err != nil {
+			log.Printf("GetStoredHashes() scan error: %v", err)
+			return nil, errors.New("Failed to look up stored hashes.")
+		}
+		stored[hash] = true
+	}
+	return stored, nil
+}
+
+// FindHashOwner returns the ID of an app with a development file that has
+// the given hash (i.e. one whose cache holds that blob), or "" if none do.
+func FindHashOwner(db *sql.DB, hash string) (appID string, err error) {
+	err = db.QueryRow(
+		fmt.Sprintf("SELECT app_id FROM %s WHERE hash = $1 AND %s LIMIT 1",
+			filesTable, subClause("")), hash).Scan(&appID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		log.Printf("FindHashOwner() error: %v", err)
+		return "", errors.New("Failed to look up stored hashes.")
+	}
+	return appID, nil
+}
+
 func resourceExists(db *sql.DB, name string, resourceID string) (bool, error) {
 	rows, err := db.Query(
 		fmt.Sprintf("SELECT count(*) FROM %s WHERE %s = $1", filesTable, name),
@@ -215,25 +285,426 @@ func SubmissionExists(db *sql.DB, submissionID string) (bool, error) {
 	return resourceExists(db, "submission_id", submissionID)
 }
 
-// MakeSnapshot takes an app ID and makes a copy of the rows with the
-// column "submission_id" set to the one given.
-func MakeSnapshot(db *sql.DB, appID string, submissionID string) error {
-	files, err := GetFiles(db, appID, "") // fetch current dev file rows
+// MakeSnapshot takes an app ID and adds rows for `files` (name -> SHA-256
+// hash) with the column "submission_id" set to the one given. It's all or
+// nothing, so that a failed submit can't leave rows behind that would make
+// SubmissionExists() reject a retry.
+func MakeSnapshot(db *sql.DB, appID string, submissionID string,
+	files map[string]string) error {
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("[MakeSnapshot() get error]: %s, %v", appID, err)
-		return errors.New("Problem retrieving files for the snapshot")
+		log.Printf("[MakeSnapshot() begin error]: %s, %s, %v", appID,
+			submissionID, err)
+		return errors.New("Problem saving the snapshot")
 	}
 	for name, hash := range files {
-		err := AddFile(db, appID, submissionID, name, hash)
+		_, err := tx.Exec(
+			fmt.Sprintf("INSERT INTO %s (submission_id, app_id, name, hash) "+
+				"VALUES ($1, $2, $3, $4)", filesTable),
+			submissionID, appID, name, hash)
 		if err != nil {
+			tx.Rollback()
 			log.Printf("[MakeSnapshot() add error]: %s, %s, %s, %s, %v",
 				appID, submissionID, name, hash, err)
-			return errors.New("Problem retrieving files for the snapshot")
+			return errors.New("Problem saving the snapshot")
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[MakeSnapshot() commit error]: %s, %s, %v", appID,
+			submissionID, err)
+		return errors.New("Problem saving the snapshot")
+	}
 	return nil // success
 }
 
+// DeleteSnapshot removes the rows copied by MakeSnapshot, so that a submit
+// job that was interrupted part of the way through can start again.
+func DeleteSnapshot(db *sql.DB, appID string, submissionID string) error {
+	rows, err := db.Query(
+		fmt.Sprintf("DELETE FROM %s WHERE app_id = $1 AND submission_id = $2",
+			filesTable), appID, submissionID)
+	if err != nil {
+		log.Printf("[DeleteSnapshot() error]: %s, %s, %v", appID,
+			submissionID, err)
+		return errors.New("Problem removing a previous snapshot")
+	}
+	rows.Close()
+	return nil
+}
+
+// AddRevision records `files` (name -> SHA-256 hash) as a revision of the
+// given app and returns its token. Pass an empty `userID` if unknown.
+func AddRevision(db *sql.DB, appID string, userID string,
+	files map[string]string) (token string, err error) {
+	b, err := json.Marshal(files)
+	if err != nil {
+		log.Printf("AddRevision() marshal error: %v", err)
+		return "", errors.New("Failed to save revision.")
+	}
+	token = RevisionToken(files)
+	rows, err := db.Query(
+		fmt.Sprintf("INSERT INTO %s (app_id, token, user_id, files) "+
+			"VALUES ($1, $2, $3, $4)", revisionsTable),
+		appID, token, userID, string(b))
+	if err != nil {
+		log.Printf("AddRevision() error: %v", err)
+		return "", errors.New("Failed to save revision.")
+	}
+	rows.Close()
+	return token, nil
+}
+
+// GetRevision returns the files (name -> SHA-256 hash) recorded for the
+// given revision token, or nil if we have no record of it. An app with no
+// files needs no record.
+func GetRevision(db *sql.DB, appID string, token string) (
+	files map[string]string, err error) {
+	if token == RevisionToken(map[string]string{}) {
+		return map[string]string{}, nil
+	}
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT files FROM %s WHERE app_id = $1 AND token = $2 "+
+			"ORDER BY id DESC LIMIT 1", revisionsTable), appID, token)
+	if err != nil {
+		log.Printf("GetRevision() query error: %v", err)
+		return nil, errors.New("Failed to retrieve revision.")
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, nil
+	}
+	var b string
+	if err := rows.Scan(&b); err != nil {
+		log.Printf("GetRevision() scan error: %v", err)
+		return nil, errors.New("Failed to retrieve revision.")
+	}
+	if err := json.Unmarshal([]byte(b), &files); err != nil {
+		log.Printf("GetRevision() unmarshal error: %v", err)
+		return nil, errors.New("Failed to retrieve revision.")
+	}
+	return files, nil
+}
+
+// PruneRevisions deletes all but the most recent `keep` revisions of an app.
+func PruneRevisions(db *sql.DB, appID string, keep int) error {
+	rows, err := db.Query(
+		fmt.Sprintf("DELETE FROM %s WHERE app_id = $1 AND id NOT IN "+
+			"(SELECT id FROM %s WHERE app_id = $1 ORDER BY id DESC "+
+			"LIMIT $2)", revisionsTable, revisionsTable), appID, keep)
+	if err != nil {
+		log.Printf("PruneRevisions() error: %v", err)
+		return errors.New("Failed to prune revisions.")
+	}
+	rows.Close()
+	return nil
+}
+
+// AddWebhook saves a new webhook subscription and sets its ID.
+func AddWebhook(db *sql.DB, hook *Webhook) error {
+	err := db.QueryRow(
+		fmt.Sprintf("INSERT INTO %s (app_id, url, secret, events) "+
+			"VALUES ($1, $2, $3, $4) RETURNING id, created", webhooksTable),
+		hook.AppID, hook.URL, hook.secret, strings.Join(hook.Events, ",")).Scan(
+		&hook.ID, &hook.Created)
+	if err != nil {
+		log.Printf("AddWebhook() error: %v", err)
+		return errors.New("Failed to save webhook.")
+	}
+	return nil
+}
+
+// DeleteWebhook removes a webhook subscription (and its delivery log).
+func DeleteWebhook(db *sql.DB, appID string, id int64) error {
+	for _, table := range []string{webhookDeliveriesTable, webhooksTable} {
+		col := "id"
+		if table == webhookDeliveriesTable {
+			col = "webhook_id"
+		}
+		rows, err := db.Query(
+			fmt.Sprintf("DELETE FROM %s WHERE app_id = $1 AND %s = $2",
+				table, col), appID, id)
+		if err != nil {
+			log.Printf("DeleteWebhook() error: %v", err)
+			return errors.New("Failed to delete webhook.")
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// GetWebhooks returns the webhook subscriptions for an app. If `id` is not
+// zero, only that webhook is returned.
+func GetWebhooks(db *sql.DB, appID string, id int64) (hooks []*Webhook,
+	err error) {
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT id, app_id, url, secret, events, created "+
+			"FROM %s WHERE app_id = $1 AND ($2 = 0 OR id = $2) ORDER BY id",
+			webhooksTable), appID, id)
+	if err != nil {
+		log.Printf("GetWebhooks() query error: %v", err)
+		return nil, errors.New("Failed to retrieve webhooks.")
+	}
+	defer rows.Close()
+	hooks = []*Webhook{}
+	for rows.Next() {
+		hook := &Webhook{}
+		var events string
+		err := rows.Scan(&hook.ID, &hook.AppID, &hook.URL, &hook.secret,
+			&events, &hook.Created)
+		if err != nil {
+			log.Printf("GetWebhooks() scan error: %v", err)
+			return nil, errors.New("Failed to retrieve webhooks.")
+		}
+		hook.Events = strings.Split(events, ",")
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// AddWebhookDelivery logs one attempt to deliver a webhook event.
+func AddWebhookDelivery(db *sql.DB, d *WebhookDelivery) error {
+	rows, err := db.Query(
+		fmt.Sprintf("INSERT INTO %s (webhook_id, app_id, delivery_id, event, "+
+			"payload, attempt, status_code, error) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", webhookDeliveriesTable),
+		d.WebhookID, d.AppID, d.DeliveryID, d.Event, d.Payload, d.Attempt,
+		d.StatusCode, d.Error)
+	if err != nil {
+		log.Printf("AddWebhookDelivery() error: %v", err)
+		return errors.New("Failed to log webhook delivery.")
+	}
+	rows.Close()
+	return nil
+}
+
+// GetWebhookDeliveries returns the most recent delivery attempts for a
+// webhook, newest first.
+func GetWebhookDeliveries(db *sql.DB, appID string, webhookID int64,
+	limit int) (deliveries []*WebhookDelivery, err error) {
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT webhook_id, app_id, delivery_id, event, payload, "+
+			"attempt, status_code, error, created FROM %s WHERE app_id = $1 "+
+			"AND webhook_id = $2 ORDER BY id DESC LIMIT $3",
+			webhookDeliveriesTable), appID, webhookID, limit)
+	if err != nil {
+		log.Printf("GetWebhookDeliveries() query error: %v", err)
+		return nil, errors.New("Failed to retrieve webhook deliveries.")
+	}
+	defer rows.Close()
+	deliveries = []*WebhookDelivery{}
+	for rows.Next() {
+		d := &WebhookDelivery{}
+		err := rows.Scan(&d.WebhookID, &d.AppID, &d.DeliveryID, &d.Event,
+			&d.Payload, &d.Attempt, &d.StatusCode, &d.Error, &d.Created)
+		if err != nil {
+			log.Printf("GetWebhookDeliveries() scan error: %v", err)
+			return nil, errors.New("Failed to retrieve webhook deliveries.")
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// AddAuditEntry appends an entry to the audit log. Note that there are
+// deliberately no functions to update or delete entries.
+func AddAuditEntry(db *sql.DB, e *AuditEntry) error {
+	b, err := json.Marshal(e.Files)
+	if err != nil {
+		log.Printf("AddAuditEntry() marshal error: %v", err)
+		return errors.New("Failed to save audit entry.")
+	}
+	rows, err := db.Query(
+		fmt.Sprintf("INSERT INTO %s (action, app_id, submission_id, user_id, "+
+			"source_ip, files, outcome, message) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", auditTable),
+		e.Action, e.AppID, e.SubmissionID, e.UserID, e.SourceIP, string(b),
+		e.Outcome, e.Message)
+	if err != nil {
+		log.Printf("AddAuditEntry() error: %v", err)
+		return errors.New("Failed to save audit entry.")
+	}
+	rows.Close()
+	return nil
+}
+
+// GetAuditEntries returns up to `limit` audit log entries for an app,
+// newest first, matching the non-zero fields of `q`.
+func GetAuditEntries(db *sql.DB, appID string, q *AuditQuery, limit int) (
+	entries []*AuditEntry, err error) {
+	clauses := []string{"app_id = $1"}
+	args := []interface{}{appID}
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		clauses = append(clauses, fmt.Sprintf(clause, len(args)))
+	}
+	if q.UserID != "" {
+		add("user_id = $%d", q.UserID)
+	}
+	if !q.From.IsZero() {
+		add("created >= $%d", q.From)
+	}
+	if !q.To.IsZero() {
+		add("created < $%d", q.To)
+	}
+	if q.BeforeID > 0 {
+		add("id < $%d", q.BeforeID)
+	}
+	args = append(args, limit)
+
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT id, created, action, app_id, submission_id, "+
+			"user_id, source_ip, files, outcome, message FROM %s WHERE %s "+
+			"ORDER BY id DESC LIMIT $%d", auditTable,
+			strings.Join(clauses, " AND "), len(args)), args...)
+	if err != nil {
+		log.Printf("GetAuditEntries() query error: %v", err)
+		return nil, errors.New("Failed to retrieve the audit log.")
+	}
+	defer rows.Close()
+	entries = []*AuditEntry{}
+	for rows.Next() {
+		e := &AuditEntry{}
+		var files string
+		err := rows.Scan(&e.ID, &e.Created, &e.Action, &e.AppID,
+			&e.SubmissionID, &e.UserID, &e.SourceIP, &files, &e.Outcome,
+			&e.Message)
+		if err == nil {
+			err = json.Unmarshal([]byte(files), &e.Files)
+		}
+		if err != nil {
+			log.Printf("GetAuditEntries() scan error: %v", err)
+			return nil, errors.New("Failed to retrieve the audit log.")
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// AddAppEvent saves an event, filling in its ID, and notifies every
+// bundler instance listening on `channel` about it.
+func AddAppEvent(db *sql.DB, channel string, e *AppEvent) error {
+	err := db.QueryRow(
+		fmt.Sprintf("INSERT INTO %s (type, app_id, submission_id, user_id, "+
+			"created) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			appEventsTable),
+		e.Type, e.AppID, e.SubmissionID, e.UserID, e.Timestamp).Scan(&e.ID)
+	if err != nil {
+		log.Printf("AddAppEvent() error: %v", err)
+		return errors.New("Failed to save event.")
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("AddAppEvent() marshal error: %v", err)
+		return errors.New("Failed to send event.")
+	}
+	rows, err := db.Query("SELECT pg_notify($1, $2)", channel, string(b))
+	if err != nil {
+		log.Printf("AddAppEvent() notify error: %v", err)
+		return errors.New("Failed to send event.")
+	}
+	rows.Close()
+	return nil
+}
+
+// GetAppEvents returns up to `limit` of an app's events after `afterID`,
+// oldest first.
+func GetAppEvents(db *sql.DB, appID string, afterID int64, limit int) (
+	events []*AppEvent, err error) {
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT id, type, app_id, submission_id, user_id, "+
+			"created FROM %s WHERE app_id = $1 AND id > $2 "+
+			"ORDER BY id LIMIT $3", appEventsTable), appID, afterID, limit)
+	if err != nil {
+		log.Printf("GetAppEvents() query error: %v", err)
+		return nil, errors.New("Failed to retrieve events.")
+	}
+	defer rows.Close()
+	events = []*AppEvent{}
+	for rows.Next() {
+		e := &AppEvent{}
+		err := rows.Scan(&e.ID, &e.Type, &e.AppID, &e.SubmissionID,
+			&e.UserID, &e.Timestamp)
+		if err != nil {
+			log.Printf("GetAppEvents() scan error: %v", err)
+			return nil, errors.New("Failed to retrieve events.")
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// PruneAppEvents deletes all but the most recent `keep` events of an app.
+func PruneAppEvents(db *sql.DB, appID string, keep int) error {
+	rows, err := db.Query(
+		fmt.Sprintf("DELETE FROM %s WHERE app_id = $1 AND id NOT IN "+
+			"(SELECT id FROM %s WHERE app_id = $1 ORDER BY id DESC "+
+			"LIMIT $2)", appEventsTable, appEventsTable), appID, keep)
+	if err != nil {
+		log.Printf("PruneAppEvents() error: %v", err)
+		return errors.New("Failed to prune events.")
+	}
+	rows.Close()
+	return nil
+}
+
+// AddPullCacheEntry records that a pull response is cached under `key`.
+func AddPullCacheEntry(db *sql.DB, appID string, submissionID string,
+	key string) error {
+	rows, err := db.Query(
+		fmt.Sprintf("INSERT INTO %s (app_id, submission_id, cache_key) "+
+			"VALUES ($1, $2, $3)", pullCacheTable), appID, submissionID, key)
+	if err != nil {
+		log.Printf("AddPullCacheEntry() error: %v", err)
+		return errors.New("Failed to index the cached pull.")
+	}
+	rows.Close()
+	return nil
+}
+
+// HasPullCacheEntry returns true if a pull response was cached under `key`
+// within the last `maxAge`.
+func HasPullCacheEntry(db *sql.DB, appID string, submissionID string,
+	key string, maxAge time.Duration) (bool, error) {
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT 1 FROM %s WHERE app_id = $1 AND "+
+			"submission_id = $2 AND cache_key = $3 AND "+
+			"created > now() - $4 * interval '1 second' LIMIT 1",
+			pullCacheTable), appID, submissionID, key, int(maxAge.Seconds()))
+	if err != nil {
+		log.Printf("HasPullCacheEntry() error: %v", err)
+		return false, errors.New("Failed to look up the cached pull.")
+	}
+	defer rows.Close()
+	return rows.Next(), nil
+}
+
+// DeletePullCacheEntries removes the index rows for an app's cached pull
+// responses older than `maxAge` (or all of them, if it's zero) and returns
+// their keys, so that the responses themselves can be deleted.
+func DeletePullCacheEntries(db *sql.DB, appID string, submissionID string,
+	maxAge time.Duration) (keys []string, err error) {
+	rows, err := db.Query(
+		fmt.Sprintf("DELETE FROM %s WHERE app_id = $1 AND "+
+			"submission_id = $2 AND "+
+			"created <= now() - $3 * interval '1 second' RETURNING cache_key",
+			pullCacheTable), appID, submissionID, int(maxAge.Seconds()))
+	if err != nil {
+		log.Printf("DeletePullCacheEntries() error: %v", err)
+		return nil, errors.New("Failed to remove cached pulls.")
+	}
+	defer rows.Close()
+	keys = []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			log.Printf("DeletePullCacheEntries() scan error: %v", err)
+			return nil, errors.New("Failed to remove cached pulls.")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 // CreateTables lazily creates the required tables in the bundler DB.
 func CreateTables() {
 	db := OpenDB()
@@ -274,13 +745,157 @@ func CreateTables() {
 		log.Fatalf("Error creating unique indexes: %v", err)
 	}
 
+	// Lazily create our revisions table (snapshots of an app's listing,
+	// keyed by the token we hand out as an ETag)
+	rows, err = db.Query(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			app_id varchar(64) NOT NULL,
+			token varchar(64) NOT NULL, /* see RevisionToken() */
+			user_id varchar(64) DEFAULT null,
+			files text NOT NULL, /* JSON object of name -> hash */
+			created timestamp NOT NULL DEFAULT now()
+		)
+	`, revisionsTable))
+	rows.Close()
+	if err != nil {
+		log.Fatalf("Error creating table: %v", err)
+	}
+
+	// Lazily create our webhook subscriptions and their delivery log
+	rows, err = db.Query(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			app_id varchar(64) NOT NULL,
+			url text NOT NULL,
+			secret text NOT NULL, /* HMAC-SHA256 key for signing payloads */
+			events text NOT NULL, /* comma-separated, see WebhookEvents */
+			created timestamp NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			webhook_id bigint NOT NULL,
+			app_id varchar(64) NOT NULL,
+			delivery_id varchar(64) NOT NULL, /* shared by retries */
+			event varchar(64) NOT NULL,
+			payload text NOT NULL,
+			attempt int NOT NULL,
+			status_code int NOT NULL, /* 0 if there was no response */
+			error text NOT NULL,
+			created timestamp NOT NULL DEFAULT now()
+		)
+	`, webhooksTable, webhookDeliveriesTable))
+	rows.Close()
+	if err != nil {
+		log.Fatalf("Error creating table: %v", err)
+	}
+
+	// Lazily create our audit log, which is append-only (postgres rules
+	// silently discard any UPDATE or DELETE).
+	rows, err = db.Query(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			created timestamp NOT NULL DEFAULT now(),
+			action varchar(32) NOT NULL, /* see the Audit* constants */
+			app_id varchar(64) NOT NULL,
+			submission_id varchar(64) NOT NULL,
+			user_id varchar(64) NOT NULL,
+			source_ip varchar(64) NOT NULL,
+			files text NOT NULL, /* JSON, see AuditFiles */
+			outcome varchar(32) NOT NULL,
+			message text NOT NULL
+		);
+		CREATE OR REPLACE RULE %s_no_update AS ON UPDATE TO %s
+			DO INSTEAD NOTHING;
+		CREATE OR REPLACE RULE %s_no_delete AS ON DELETE TO %s
+			DO INSTEAD NOTHING;
+	`, auditTable, auditTable, auditTable, auditTable, auditTable))
+	rows.Close()
+	if err != nil {
+		log.Fatalf("Error creating table: %v", err)
+	}
+
+	// Lazily create our submit job queue. Only one job that hasn't failed
+	// can exist for each submission ID.
+	rows, err = db.Query(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			app_id varchar(64) NOT NULL,
+			submission_id varchar(64) NOT NULL,
+			user_id varchar(64) NOT NULL DEFAULT '', /* may be unknown */
+			source_ip varchar(64) NOT NULL,
+			status varchar(16) NOT NULL, /* see the SubmitJob* constants */
+			progress int NOT NULL DEFAULT 0, /* percent */
+			stage varchar(32) NOT NULL DEFAULT '',
+			error text NOT NULL DEFAULT '',
+			attempts int NOT NULL DEFAULT 0,
+			revision varchar(64) NOT NULL DEFAULT '',
+			files text NOT NULL DEFAULT '', /* JSON, or '' for the dev files */
+			created timestamp NOT NULL DEFAULT now(),
+			updated timestamp NOT NULL DEFAULT now() /* also the heartbeat */
+		);
+		DO $$
+		BEGIN
+			IF (SELECT to_regclass('submit_jobs_submission_id_index')) IS NULL
+			THEN
+				CREATE UNIQUE INDEX submit_jobs_submission_id_index
+					ON %s(submission_id) WHERE status <> 'failed';
+			END IF;
+		END $$;
+	`, submitJobsTable, submitJobsTable))
+	rows.Close()
+	if err != nil {
+		log.Fatalf("Error creating table: %v", err)
+	}
+
+	// Lazily create our recent app events, kept so that /v1/events/
+	// clients can resume after a restart (see PruneAppEvents())
+	rows, err = db.Query(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			type varchar(32) NOT NULL, /* see the Event* constants */
+			app_id varchar(64) NOT NULL,
+			submission_id varchar(64) NOT NULL,
+			user_id varchar(64) NOT NULL,
+			created timestamp NOT NULL
+		)
+	`, appEventsTable))
+	rows.Close()
+	if err != nil {
+		log.Fatalf("Error creating table: %v", err)
+	}
+
+	// Lazily create our index of cached pull responses (see pullcache.go)
+	rows, err = db.Query(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			app_id varchar(64) NOT NULL,
+			submission_id varchar(64) NOT NULL, /* '' for development */
+			cache_key text NOT NULL, /* see PullCacheKey() */
+			created timestamp NOT NULL DEFAULT now()
+		)
+	`, pullCacheTable))
+	rows.Close()
+	if err != nil {
+		log.Fatalf("Error creating table: %v", err)
+	}
+
 	// Lazily create our column indices
-	indices := map[string]string{
-		"files_app_id_index":        "app_id",
-		"files_name_index":          "name",
-		"files_submission_id_index": "submission_id",
+	indices := map[string][2]string{
+		"files_app_id_index":           {filesTable, "app_id"},
+		"files_name_index":             {filesTable, "name"},
+		"files_submission_id_index":    {filesTable, "submission_id"},
+		"revisions_app_id_token_index": {revisionsTable, "app_id, token"},
+		"webhooks_app_id_index":        {webhooksTable, "app_id"},
+		"webhook_deliveries_webhook_id_index": {webhookDeliveriesTable,
+			"webhook_id"},
+		"audit_log_app_id_index":   {auditTable, "app_id, id"},
+		"submit_jobs_status_index": {submitJobsTable, "status, id"},
+		"app_events_app_id_index":  {appEventsTable, "app_id, id"},
+		"pull_cache_app_id_index": {pullCacheTable,
+			"app_id, submission_id, cache_key"},
 	}
-	for indexName, cols := range indices {
+	for indexName, index := range indices {
 		rows, err = db.Query(fmt.Sprintf(`
 			DO $$
 			BEGIN
@@ -288,10 +903,132 @@ func CreateTables() {
 					CREATE INDEX %s ON %s(%s);
 				END IF;
 			END $$;
-		`, indexName, indexName, filesTable, cols))
+		`, indexName, indexName, index[0], index[1]))
 		rows.Close()
 		if err != nil {
 			log.Fatalf("Error creating index %s: %v", indexName, err)
 		}
 	}
 }
+
+// AddSubmitJob queues a submit job, filling in its ID. It returns
+// errSubmissionExists if there's already a job for the submission ID that
+// hasn't failed.
+func AddSubmitJob(db *sql.DB, job *SubmitJob) error {
+	files := ""
+	if job.Files != nil {
+		b, err := json.Marshal(job.Files)
+		if err != nil {
+			log.Printf("AddSubmitJob() marshal error: %v", err)
+			return errors.New("Failed to queue the submission.")
+		}
+		files = string(b)
+	}
+	err := db.QueryRow(
+		fmt.Sprintf("INSERT INTO %s (app_id, submission_id, user_id, "+
+			"source_ip, status, revision, files) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7) "+
+			"RETURNING id, created, updated", submitJobsTable),
+		job.AppID, job.SubmissionID, job.UserID, job.SourceIP,
+		SubmitJobQueued, job.Revision, files).Scan(&job.ID, &job.Created,
+		&job.Updated)
+	if e, ok := err.(*pq.Error); ok && e.Code == pqUniqueViolation {
+		return errSubmissionExists
+	} else if err != nil {
+		log.Printf("AddSubmitJob() error: %v", err)
+		return errors.New("Failed to queue the submission.")
+	}
+	job.Status = SubmitJobQueued
+	return nil
+}
+
+const submitJobColumns = "id, app_id, submission_id, user_id, source_ip, " +
+	"status, progress, stage, error, attempts, revision, files, created, " +
+	"updated"
+
+func scanSubmitJob(row interface {
+	Scan(...interface{}) error
+}) (*SubmitJob, error) {
+	j := &SubmitJob{}
+	var files string
+	err := row.Scan(&j.ID, &j.AppID, &j.SubmissionID, &j.UserID, &j.SourceIP,
+		&j.Status, &j.Progress, &j.Stage, &j.Error, &j.Attempts,
+		&j.Revision, &files, &j.Created, &j.Updated)
+	if err == nil && files != "" {
+		err = json.Unmarshal([]byte(files), &j.Files)
+	}
+	return j, err
+}
+
+// GetSubmitJob returns an app's submit job by ID, or nil if there's no
+// such job.
+func GetSubmitJob(db *sql.DB, appID string, id int64) (*SubmitJob, error) {
+	job, err := scanSubmitJob(db.QueryRow(
+		fmt.Sprintf("SELECT %s FROM %s WHERE app_id = $1 AND id = $2",
+			submitJobColumns, submitJobsTable), appID, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Printf("GetSubmitJob() error: %v", err)
+		return nil, errors.New("Failed to retrieve the submit job.")
+	}
+	return job, nil
+}
+
+// ClaimSubmitJob marks the oldest queued job as running and returns it, or
+// nil if there's nothing to do. Running jobs whose heartbeat is older than
+// `stale` are claimed too, since whoever was running them has died. If two
+// bundlers race for the same job, the loser's UPDATE matches no rows once
+// the winner's has committed.
+func ClaimSubmitJob(db *sql.DB, stale time.Duration) (*SubmitJob, error) {
+	claimable := fmt.Sprintf("(status = '%s' OR (status = '%s' AND "+
+		"updated < now() - interval '%d seconds'))", SubmitJobQueued,
+		SubmitJobRunning, int(stale.Seconds()))
+	job, err := scanSubmitJob(db.QueryRow(
+		fmt.Sprintf("UPDATE %s SET status = $1, attempts = attempts + 1, "+
+			"updated = now() WHERE id = (SELECT id FROM %s WHERE %s "+
+			"ORDER BY id LIMIT 1) AND %s RETURNING %s", submitJobsTable,
+			submitJobsTable, claimable, claimable, submitJobColumns),
+		SubmitJobRunning))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		log.Printf("ClaimSubmitJob() error: %v", err)
+		return nil, errors.New("Failed to claim a submit job.")
+	}
+	return job, nil
+}
+
+// UpdateSubmitJob records a running job's progress, which also serves as
+// its heartbeat.
+func UpdateSubmitJob(db *sql.DB, id int64, progress int, stage string) error {
+	rows, err := db.Query(
+		fmt.Sprintf("UPDATE %s SET progress = $1, stage = $2, "+
+			"updated = now() WHERE id = $3", submitJobsTable),
+		progress, stage, id)
+	if err != nil {
+		log.Printf("UpdateSubmitJob() error: %v", err)
+		return errors.New("Failed to update the submit job.")
+	}
+	rows.Close()
+	return nil
+}
+
+// FinishSubmitJob marks a job as succeeded or failed.
+func FinishSubmitJob(db *sql.DB, id int64, status string,
+	errMsg string) error {
+	progress := 0
+	if status == SubmitJobSucceeded {
+		progress = 100
+	}
+	rows, err := db.Query(
+		fmt.Sprintf("UPDATE %s SET status = $1, error = $2, progress = "+
+			"GREATEST(progress, $3), stage = '', updated = now() "+
+			"WHERE id = $4", submitJobsTable), status, errMsg, progress, id)
+	if err != nil {
+		log.Printf("FinishSubmitJob() error: %v", err)
+		return errors.New("Failed to update the submit job.")
+	}
+	rows.Close()
+	return nil
+}
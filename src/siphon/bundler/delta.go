@@ -0,0 +1,199 @@
+package bundler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// A delta describes how to build a new version of a file from an old one.
+// It is laid out as:
+//
+//	"SDL1"                      magic
+//	uvarint                     length of the new file
+//	ops...                      until the new file is complete, where each
+//	                            op is one of:
+//	  0x01 uvarint uvarint        copy (offset, length) from the old file
+//	  0x02 uvarint bytes          insert (length) literal bytes
+//	[32]byte                    SHA-256 of the new file
+//
+// MakeDelta and ApplyDelta implement both sides, so that clients (and
+// tests) can check a delta round-trips.
+
+const deltaMagic = "SDL1"
+
+const (
+	deltaOpCopy   byte = 0x01
+	deltaOpInsert byte = 0x02
+)
+
+// Matches shorter than this aren't worth a copy op
+const deltaBlockSize = 32
+
+// Caps how many old offsets we remember per block hash, so that files with
+// lots of repetition don't blow up the index.
+const deltaMaxCandidates = 8
+
+var errBadDelta = errors.New("Malformed or mismatched delta.")
+
+// The rolling hash is a polynomial hash over deltaBlockSize bytes.
+const deltaHashBase uint32 = 16777619
+
+func deltaHashPow() uint32 {
+	p := uint32(1)
+	for i := 0; i < deltaBlockSize-1; i++ {
+		p *= deltaHashBase
+	}
+	return p
+}
+
+func deltaHash(b []byte) uint32 {
+	var h uint32
+	for _, c := range b {
+		h = h*deltaHashBase + uint32(c)
+	}
+	return h
+}
+
+type deltaWriter struct {
+	buf     bytes.Buffer
+	pending []byte // literal bytes not yet written as an insert op
+}
+
+func (w *deltaWriter) uvarint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (w *deltaWriter) flushInsert() {
+	if len(w.pending) == 0 {
+		return
+	}
+	w.buf.WriteByte(deltaOpInsert)
+	w.uvarint(uint64(len(w.pending)))
+	w.buf.Write(w.pending)
+	w.pending = nil
+}
+
+func (w *deltaWriter) copy(offset int, length int) {
+	w.flushInsert()
+	w.buf.WriteByte(deltaOpCopy)
+	w.uvarint(uint64(offset))
+	w.uvarint(uint64(length))
+}
+
+// MakeDelta returns a delta that turns `old` into `new` (see ApplyDelta).
+func MakeDelta(old []byte, new []byte) []byte {
+	w := &deltaWriter{}
+	w.buf.WriteString(deltaMagic)
+	w.uvarint(uint64(len(new)))
+
+	// Index the old file's blocks by their hash
+	index := map[uint32][]int{}
+	for i := 0; i+deltaBlockSize <= len(old); i += deltaBlockSize {
+		h := deltaHash(old[i : i+deltaBlockSize])
+		if len(index[h]) < deltaMaxCandidates {
+			index[h] = append(index[h], i)
+		}
+	}
+
+	// Roll through the new file looking for blocks we've seen before
+	pow := deltaHashPow()
+	i := 0
+	var h uint32
+	if len(new) >= deltaBlockSize {
+		h = deltaHash(new[:deltaBlockSize])
+	}
+	for i+deltaBlockSize <= len(new) {
+		bestOffset, bestLength := -1, 0
+		for _, offset := range index[h] {
+			n := 0
+			for offset+n < len(old) && i+n < len(new) &&
+				old[offset+n] == new[i+n] {
+				n++
+			}
+			if n > bestLength {
+				bestOffset, bestLength = offset, n
+			}
+		}
+		if bestLength >= deltaBlockSize {
+			// Extend the match backwards into any pending literal bytes
+			back := 0
+			for back < len(w.pending) && bestOffset-back > 0 &&
+				old[bestOffset-back-1] == w.pending[len(w.pending)-back-1] {
+				back++
+			}
+			w.pending = w.pending[:len(w.pending)-back]
+			w.copy(bestOffset-back, bestLength+back)
+			i += bestLength
+			if i+deltaBlockSize <= len(new) {
+				h = deltaHash(new[i : i+deltaBlockSize])
+			}
+			continue
+		}
+		// No match, so this byte is a literal. Roll the hash along.
+		w.pending = append(w.pending, new[i])
+		if i+deltaBlockSize < len(new) {
+			h = (h-uint32(new[i])*pow)*deltaHashBase +
+				uint32(new[i+deltaBlockSize])
+		}
+		i++
+	}
+	w.pending = append(w.pending, new[i:]...)
+	w.flushInsert()
+
+	sum := sha256.Sum256(new)
+	w.buf.Write(sum[:])
+	return w.buf.Bytes()
+}
+
+// ApplyDelta builds the new file from `old` and a delta made by MakeDelta,
+// returning an error if the delta is malformed or doesn't apply to `old`.
+func ApplyDelta(old []byte, delta []byte) ([]byte, error) {
+	if len(delta) < len(deltaMagic)+sha256.Size ||
+		string(delta[:len(deltaMagic)]) != deltaMagic {
+		return nil, errBadDelta
+	}
+	sum := delta[len(delta)-sha256.Size:]
+	r := bytes.NewReader(delta[len(deltaMagic) : len(delta)-sha256.Size])
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > uint64(len(delta))*uint64(len(old)+1) {
+		return nil, errBadDelta
+	}
+	out := make([]byte, 0, size)
+	for uint64(len(out)) < size {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, errBadDelta
+		}
+		switch op {
+		case deltaOpCopy:
+			offset, err1 := binary.ReadUvarint(r)
+			length, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || offset > uint64(len(old)) ||
+				length > uint64(len(old))-offset {
+				return nil, errBadDelta
+			}
+			out = append(out, old[offset:offset+length]...)
+		case deltaOpInsert:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > uint64(r.Len()) {
+				return nil, errBadDelta
+			}
+			literal := make([]byte, length)
+			r.Read(literal)
+			out = append(out, literal...)
+		default:
+			return nil, errBadDelta
+		}
+	}
+	if uint64(len(out)) != size || r.Len() != 0 {
+		return nil, errBadDelta
+	}
+	if actual := sha256.Sum256(out); !bytes.Equal(actual[:], sum) {
+		return nil, errBadDelta
+	}
+	return out, nil
+}
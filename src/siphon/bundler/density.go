@@ -0,0 +1,84 @@
+package bundler
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Images can come in several densities, e.g. "foo.png", "foo@2x.png" and
+// "foo@3x.png". A device only needs the one that best matches its screen.
+var densityExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
+var densitySuffix = regexp.MustCompile(`@(\d+(?:\.\d+)?)x$`)
+
+// imageDensity splits an image name like "foo@2x.png" into the name shared
+// by all of its variants ("foo.png") and its scale (2). A platform suffix
+// comes after the scale ("foo@2x.ios.png" is a variant of "foo.ios.png").
+// It returns false if `name` isn't an image.
+func imageDensity(name string) (base string, scale float64, ok bool) {
+	platform, name := filePlatform(name)
+	if platform != "" {
+		ext := path.Ext(name)
+		base, scale, ok = imageDensity(name)
+		return strings.TrimSuffix(base, ext) + "." + platform + ext, scale, ok
+	}
+	ext := path.Ext(name)
+	isImage := false
+	for _, e := range densityExtensions {
+		if strings.ToLower(ext) == e {
+			isImage = true
+			break
+		}
+	}
+	if !isImage {
+		return "", 0, false
+	}
+	stem := strings.TrimSuffix(name, ext)
+	m := densitySuffix.FindStringSubmatch(stem)
+	if m == nil {
+		return name, 1, true
+	}
+	scale, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || scale <= 0 {
+		return name, 1, true
+	}
+	return strings.TrimSuffix(stem, m[0]) + ext, scale, true
+}
+
+// betterDensity reports whether an image at scale `a` suits a screen at
+// `scale` better than one at `b`. Like React Native, we prefer the smallest
+// variant that's at least as dense as the screen, otherwise the densest.
+func betterDensity(a float64, b float64, scale float64) bool {
+	if (a >= scale) != (b >= scale) {
+		return a >= scale
+	} else if a >= scale {
+		return a < b
+	}
+	return a > b
+}
+
+// SelectDensities returns the names from `names` that a screen at `scale`
+// needs: every non-image, and the best variant of each image.
+func SelectDensities(names []string, scale float64) map[string]bool {
+	type variant struct {
+		name  string
+		scale float64
+	}
+	best := map[string]variant{}
+	selected := map[string]bool{}
+	for _, name := range names {
+		base, s, ok := imageDensity(name)
+		if !ok {
+			selected[name] = true
+			continue
+		}
+		if v, found := best[base]; !found || betterDensity(s, v.scale, scale) {
+			best[base] = variant{name, s}
+		}
+	}
+	for _, v := range best {
+		selected[v.name] = true
+	}
+	return selected
+}
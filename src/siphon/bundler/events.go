@@ -0,0 +1,274 @@
+package bundler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/lib/pq"
+)
+
+// EventAppUpdated is published whenever a push changes an app
+const EventAppUpdated = "app_updated"
+
+// EventAppSubmitted is published whenever a submission snapshot is made
+const EventAppSubmitted = "app_submitted"
+
+// How many recent events we keep per app, for clients resuming a stream
+const eventHistoryLength = 50
+
+// The postgres NOTIFY channel that events are sent to every instance on
+const eventChannel = "siphon_app_events"
+
+// How long a long-poll waits for an event by default, and at most
+const defaultPollTimeout = 30 * time.Second
+const maxPollTimeout = 60 * time.Second
+
+// SSE streams send a comment this often so that proxies don't time out
+const eventHeartbeat = 15 * time.Second
+
+// AppEvent is an update to an app, as sent to /v1/events/ clients. IDs
+// increase over time (across restarts too) so clients can resume from the
+// last one they saw.
+type AppEvent struct {
+	ID           int64     `json:"id"`
+	Type         string    `json:"type"`
+	AppID        string    `json:"app_id"`
+	SubmissionID string    `json:"submission_id,omitempty"`
+	UserID       string    `json:"user_id,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// eventBus fans events out to the clients of this instance listening for
+// each app. Events reach it from every instance (including this one)
+// through postgres LISTEN/NOTIFY, see StartEventListener().
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan *AppEvent]bool
+}
+
+var appEvents = &eventBus{
+	subscribers: map[string]map[chan *AppEvent]bool{},
+}
+
+// PublishAppEvent saves an event and sends it to anyone listening for the
+// app, on any bundler instance. It fails silently, like PostAppUpdated().
+func PublishAppEvent(appID string, eventType string, userID string,
+	submissionID string) {
+	db := OpenDB()
+	defer db.Close()
+	e := &AppEvent{Type: eventType, AppID: appID, SubmissionID: submissionID,
+		UserID: userID, Timestamp: time.Now().UTC()}
+	if err := AddAppEvent(db, eventChannel, e); err != nil {
+		log.Printf("(Ignored) Failed to publish %s event for %s: %v",
+			eventType, appID, err)
+		return
+	}
+	if err := PruneAppEvents(db, appID, eventHistoryLength); err != nil {
+		log.Printf("(Ignored) %v", err)
+	}
+}
+
+// StartEventListener passes the events every instance publishes on to this
+// instance's clients. Events sent while the listener is reconnecting are
+// lost, but clients can get them back by resuming from the last event ID.
+func StartEventListener() {
+	l := pq.NewListener(dbURL(), time.Second, time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("(Ignored) Event listener error: %v", err)
+			}
+		})
+	if err := l.Listen(eventChannel); err != nil {
+		log.Fatalf("Error listening for events: %v", err)
+	}
+	go func() {
+		for n := range l.Notify {
+			// A nil notification means the connection was re-established
+			if n == nil {
+				continue
+			}
+			e := &AppEvent{}
+			if err := json.Unmarshal([]byte(n.Extra), e); err != nil {
+				log.Printf("(Ignored) Bad event notification: %v", err)
+				continue
+			}
+			appEvents.publish(e)
+		}
+	}()
+}
+
+func (b *eventBus) publish(e *AppEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[e.AppID] {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("(Ignored) Dropped event %d for a slow client", e.ID)
+		}
+	}
+}
+
+// subscribe returns a channel of new events for an app.
+func (b *eventBus) subscribe(appID string) chan *AppEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan *AppEvent, eventHistoryLength)
+	if b.subscribers[appID] == nil {
+		b.subscribers[appID] = map[chan *AppEvent]bool{}
+	}
+	b.subscribers[appID][ch] = true
+	return ch
+}
+
+func (b *eventBus) unsubscribe(appID string, ch chan *AppEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers[appID], ch)
+	if len(b.subscribers[appID]) == 0 {
+		delete(b.subscribers, appID)
+	}
+}
+
+// writeSSE writes a single event in the text/event-stream format.
+func writeSSE(w http.ResponseWriter, e *AppEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+	return err
+}
+
+// streamEvents serves events as Server-Sent Events until the client goes
+// away. Events from `ch` up to `lastID` were already in `missed`, so they
+// are skipped.
+func streamEvents(w http.ResponseWriter, r *http.Request, ch chan *AppEvent,
+	missed []*AppEvent, lastID int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		if err := writeSSE(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-ch:
+			if e.ID <= lastID {
+				continue
+			}
+			if err := writeSSE(w, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// EventsResponse is the result of a long-poll for events.
+type EventsResponse struct {
+	Events []*AppEvent `json:"events"`
+}
+
+// pollEvents waits for at least one event (or the timeout) and returns
+// what it got as JSON. As with streamEvents(), events from `ch` up to
+// `lastID` are skipped.
+func pollEvents(w http.ResponseWriter, r *http.Request, ch chan *AppEvent,
+	missed []*AppEvent, lastID int64) {
+	timeout := defaultPollTimeout
+	if t := r.FormValue("timeout"); t != "" {
+		secs, err := strconv.Atoi(t)
+		if err != nil || secs < 0 {
+			http.Error(w, "Invalid timeout.", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(secs) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+	deadline := time.After(timeout)
+	for len(missed) == 0 {
+		select {
+		case e := <-ch:
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		case <-deadline:
+			writeJSON(w, &EventsResponse{Events: missed}, http.StatusOK)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	writeJSON(w, &EventsResponse{Events: missed}, http.StatusOK)
+}
+
+// Events handles the /v1/events/ route. Clients that accept
+// text/event-stream get a stream of events, others get a long-poll. Either
+// way, a Last-Event-ID header (or "last_event_id" parameter) replays any
+// recent events the client missed.
+func Events(w http.ResponseWriter, r *http.Request) {
+	appID := context.Get(r, AppIDKey).(string)
+	lastID := int64(-1)
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.FormValue("last_event_id")
+	}
+	if last != "" {
+		id, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "Invalid last event ID.", http.StatusBadRequest)
+			return
+		}
+		lastID = id
+	}
+
+	// Subscribe before looking up what was missed, so that nothing falls
+	// in between.
+	ch := appEvents.subscribe(appID)
+	defer appEvents.unsubscribe(appID, ch)
+	missed := []*AppEvent{}
+	if lastID >= 0 {
+		db := OpenDB()
+		events, err := GetAppEvents(db, appID, lastID, eventHistoryLength)
+		db.Close()
+		if err != nil {
+			http.Error(w, "Internal error.", 500)
+			return
+		}
+		missed = events
+		if len(missed) > 0 {
+			lastID = missed[len(missed)-1].ID
+		}
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamEvents(w, r, ch, missed, lastID)
+	} else {
+		pollEvents(w, r, ch, missed, lastID)
+	}
+}
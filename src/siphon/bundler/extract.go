@@ -0,0 +1,149 @@
+package bundler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+)
+
+// ExtractPolicy limits what we're willing to extract from a POST'd archive.
+type ExtractPolicy struct {
+	MaxEntries   int   // maximum number of files and directories
+	MaxEntrySize int64 // maximum uncompressed size of a single file
+	MaxTotalSize int64 // maximum uncompressed size of all files
+	MaxRatio     int64 // maximum uncompressed:compressed size ratio
+	FileMode     os.FileMode
+	DirMode      os.FileMode
+}
+
+// Archives smaller than this are not subject to MaxRatio, because small
+// text files can legitimately compress very well.
+const extractRatioFloor = 1 << 20
+
+// DefaultExtractPolicy is used for pushes unless overridden by the
+// EXTRACT_MAX_* environment variables (see NewExtractPolicy()).
+var DefaultExtractPolicy = ExtractPolicy{
+	MaxEntries:   20000,
+	MaxEntrySize: 100 << 20,
+	MaxTotalSize: 500 << 20,
+	MaxRatio:     100,
+	FileMode:     0600,
+	DirMode:      0700,
+}
+
+// NewExtractPolicy returns the DefaultExtractPolicy with any limits set in
+// the environment applied.
+func NewExtractPolicy() *ExtractPolicy {
+	p := DefaultExtractPolicy
+	envInt := func(key string, v *int64) {
+		if s := os.Getenv(key); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n <= 0 {
+				log.Printf("(Ignored) Invalid %s: %s", key, s)
+				return
+			}
+			*v = n
+		}
+	}
+	maxEntries := int64(p.MaxEntries)
+	envInt("EXTRACT_MAX_ENTRIES", &maxEntries)
+	p.MaxEntries = int(maxEntries)
+	envInt("EXTRACT_MAX_ENTRY_SIZE", &p.MaxEntrySize)
+	envInt("EXTRACT_MAX_TOTAL_SIZE", &p.MaxTotalSize)
+	envInt("EXTRACT_MAX_RATIO", &p.MaxRatio)
+	return &p
+}
+
+// ExtractError is returned when an archive entry breaks the ExtractPolicy.
+// Its message is suitable for showing to the user.
+type ExtractError struct {
+	Name   string
+	Reason string
+}
+
+func (e *ExtractError) Error() string {
+	return fmt.Sprintf("The archive entry %s was rejected: %s", e.Name,
+		e.Reason)
+}
+
+// extractor applies an ExtractPolicy across all the entries of one archive.
+type extractor struct {
+	policy         *ExtractPolicy
+	compressedSize int64 // size of the archive itself
+	entries        int
+	total          int64
+}
+
+func newExtractor(policy *ExtractPolicy, src string) (*extractor, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{policy: policy, compressedSize: info.Size()}, nil
+}
+
+// checkEntry is called for every entry before it is extracted, with the
+// entry's mode and the uncompressed size it claims to have.
+func (e *extractor) checkEntry(name string, mode os.FileMode,
+	size int64) error {
+	e.entries++
+	if e.entries > e.policy.MaxEntries {
+		return &ExtractError{name, fmt.Sprintf(
+			"the archive has more than %d entries", e.policy.MaxEntries)}
+	}
+	if path.IsAbs(name) {
+		return &ExtractError{name, "absolute paths are not allowed"}
+	}
+	if mode&os.ModeSymlink != 0 {
+		return &ExtractError{name, "symbolic links are not allowed"}
+	}
+	if mode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|
+		os.ModeSocket) != 0 {
+		return &ExtractError{name, "device files are not allowed"}
+	}
+	if size > e.policy.MaxEntrySize {
+		return &ExtractError{name, fmt.Sprintf(
+			"files may be at most %d bytes", e.policy.MaxEntrySize)}
+	}
+	return nil
+}
+
+// checkRatio rejects an entry whose claimed sizes suggest a zip bomb.
+func (e *extractor) checkRatio(name string, size int64,
+	compressedSize int64) error {
+	if size < extractRatioFloor {
+		return nil
+	}
+	if compressedSize <= 0 || size/compressedSize > e.policy.MaxRatio {
+		return &ExtractError{name, fmt.Sprintf(
+			"the compression ratio is higher than %d:1", e.policy.MaxRatio)}
+	}
+	return nil
+}
+
+// copy writes an entry's content, enforcing the size limits on what is
+// actually read rather than on what the archive headers claim.
+func (e *extractor) copy(dst io.Writer, src io.Reader, name string) error {
+	limit := e.policy.MaxEntrySize
+	if remaining := e.policy.MaxTotalSize - e.total; remaining < limit {
+		limit = remaining
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, limit+1))
+	e.total += n
+	if err != nil {
+		return err
+	}
+	if n > e.policy.MaxEntrySize {
+		return &ExtractError{name, fmt.Sprintf(
+			"files may be at most %d bytes", e.policy.MaxEntrySize)}
+	}
+	if e.total > e.policy.MaxTotalSize {
+		return &ExtractError{name, fmt.Sprintf(
+			"the archive may be at most %d bytes uncompressed",
+			e.policy.MaxTotalSize)}
+	}
+	return e.checkRatio(name, e.total, e.compressedSize)
+}
@@ -43,8 +43,8 @@ func GetIcons(d string, files map[string]string) (icons []*IconData,
 		// }
 		ext := path.Ext(name)
 		// Iterate through the platform-specific directories
-		for _, platform := range []string{"android", "ios"} {
-			prefix := path.Join("publish", platform, "icons")
+		for _, p := range Platforms() {
+			prefix := p.IconsDir
 			if strings.HasPrefix(name, prefix) {
 				if ext != ".png" {
 					return nil, fmt.Errorf(`Unsupported icon %s detected.
@@ -61,7 +61,7 @@ func GetIcons(d string, files map[string]string) (icons []*IconData,
 				// minus the extension
 				iconExtName, _ := filepath.Rel(prefix, name)
 				iconName := iconExtName[0 : len(iconExtName)-len(ext)]
-				iData, err := LoadIconData(iconName, platform, b)
+				iData, err := LoadIconData(iconName, p.Name, b)
 				if err != nil {
 					return nil, err
 				}
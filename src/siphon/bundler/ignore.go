@@ -0,0 +1,143 @@
+package bundler
+
+import (
+	"path"
+	"strings"
+)
+
+// The file in an app directory where we expect to find ignore patterns
+const IgnoreFileName string = ".siphonignore"
+
+// DefaultIgnorePatterns are applied to every push, before any patterns in
+// the app's .siphonignore (which can re-include them with "!").
+var DefaultIgnorePatterns = []string{
+	".git/",
+	".hg/",
+	".svn/",
+	"node_modules/",
+	".DS_Store",
+	"Thumbs.db",
+	"*.swp",
+	"*.swo",
+	"*~",
+	".#*",
+	"npm-debug.log*",
+	"/ios/build/",
+	"/android/build/",
+	"/android/app/build/",
+}
+
+type ignorePattern struct {
+	glob     string
+	negate   bool // a "!" pattern that re-includes a path
+	dirOnly  bool // a pattern with a trailing "/" only matches directories
+	anchored bool // a pattern with a "/" is matched against the whole path
+}
+
+// IgnoreRules decides which paths are ignored by a push, using
+// gitignore-style patterns.
+type IgnoreRules struct {
+	patterns []ignorePattern
+}
+
+// NewIgnoreRules returns rules made up of DefaultIgnorePatterns plus any
+// patterns in `b` (the content of a .siphonignore, or nil).
+func NewIgnoreRules(b []byte) *IgnoreRules {
+	r := &IgnoreRules{}
+	for _, line := range DefaultIgnorePatterns {
+		r.add(line)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		r.add(line)
+	}
+	return r
+}
+
+func (r *IgnoreRules) add(line string) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	p := ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // e.g. "\#file" or "\!file"
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	p.glob = line
+	r.patterns = append(r.patterns, p)
+}
+
+// match returns true if `name` is ignored, without considering its parent
+// directories. The last matching pattern wins.
+func (r *IgnoreRules) match(name string, isDir bool) bool {
+	ignored := false
+	for _, p := range r.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		var ok bool
+		if p.anchored {
+			ok = matchGlobPath(p.glob, name)
+		} else {
+			ok, _ = path.Match(p.glob, path.Base(name))
+		}
+		if ok {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// Ignored returns true if the file `name` (a slash-separated path relative
+// to the app directory) should not be stored. Like git, a file can't be
+// re-included if one of its parent directories is ignored.
+func (r *IgnoreRules) Ignored(name string) bool {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if r.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return r.match(name, false)
+}
+
+// matchGlobPath matches a slash-separated `name` against `glob`, where each
+// segment is matched with path.Match() and a "**" segment matches zero or
+// more segments.
+func matchGlobPath(glob string, name string) bool {
+	return matchSegments(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(globs []string, names []string) bool {
+	if len(globs) == 0 {
+		return len(names) == 0
+	}
+	if globs[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(globs[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(globs[0], names[0]); !ok {
+		return false
+	}
+	return matchSegments(globs[1:], names[1:])
+}
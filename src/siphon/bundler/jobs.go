@@ -0,0 +1,215 @@
+package bundler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// Submit job statuses
+const (
+	SubmitJobQueued    = "queued"
+	SubmitJobRunning   = "running"
+	SubmitJobFailed    = "failed"
+	SubmitJobSucceeded = "succeeded"
+)
+
+// How often idle workers look for queued jobs (they're also woken up when
+// a job is queued by this instance).
+const submitJobPollInterval = 5 * time.Second
+
+// Running jobs update their heartbeat this often, and a job whose
+// heartbeat is older than submitJobStaleAfter is assumed to have died
+// with its bundler and is run again.
+const submitJobHeartbeat = 30 * time.Second
+const submitJobStaleAfter = 2 * time.Minute
+
+// A job that keeps dying (e.g. it crashes the bundler) is given up on
+const maxSubmitJobAttempts = 3
+
+const defaultSubmitWorkers = 2
+
+var errSubmissionExists = errors.New("Submission ID already exists.")
+
+// SubmitJob is a queued submission, see Submit().
+type SubmitJob struct {
+	ID           int64     `json:"id"`
+	AppID        string    `json:"app_id"`
+	SubmissionID string    `json:"submission_id"`
+	Status       string    `json:"status"`
+	Progress     int       `json:"progress"` // percent
+	Stage        string    `json:"stage"`    // what it's doing right now
+	Error        string    `json:"error"`
+	Revision     string    `json:"revision,omitempty"` // if one was asked for
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+	StatusURL    string    `json:"status_url,omitempty"`
+
+	UserID   string            `json:"-"` // for the audit log
+	SourceIP string            `json:"-"` // for the audit log
+	Attempts int               `json:"-"`
+	Files    map[string]string `json:"-"` // nil for the development files
+}
+
+func submitJobStatusURL(appID string, id int64) string {
+	return fmt.Sprintf("/v1/submit/%s/jobs/%d/", appID, id)
+}
+
+var submitJobWakeup = make(chan bool, 1)
+
+// wakeSubmitWorkers lets an idle worker know there's a job to do without
+// waiting for its next poll.
+func wakeSubmitWorkers() {
+	select {
+	case submitJobWakeup <- true:
+	default:
+	}
+}
+
+// StartSubmitWorkers runs the workers that process submit jobs. The number
+// of workers can be set with SUBMIT_WORKERS.
+func StartSubmitWorkers() {
+	n := defaultSubmitWorkers
+	if s := os.Getenv("SUBMIT_WORKERS"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			n = v
+		} else {
+			log.Printf("(Ignored) Invalid SUBMIT_WORKERS: %q", s)
+		}
+	}
+	for i := 0; i < n; i++ {
+		go submitWorker()
+	}
+}
+
+func submitWorker() {
+	for {
+		db := OpenDB()
+		for {
+			job, err := ClaimSubmitJob(db, submitJobStaleAfter)
+			if err != nil || job == nil {
+				break
+			}
+			runSubmitJob(db, job)
+		}
+		db.Close()
+		select {
+		case <-submitJobWakeup:
+		case <-time.After(submitJobPollInterval):
+		}
+	}
+}
+
+// runSubmitJob runs a claimed job through to success or failure.
+func runSubmitJob(db *sql.DB, job *SubmitJob) {
+	log.Printf("[submit-job %d] Running %s/%s (attempt %d)", job.ID,
+		job.AppID, job.SubmissionID, job.Attempts)
+	failure := ""
+	defer func() {
+		status := SubmitJobSucceeded
+		if failure != "" {
+			status = SubmitJobFailed
+		}
+		if err := FinishSubmitJob(db, job.ID, status, failure); err != nil {
+			log.Printf("[submit-job %d] %v", job.ID, err)
+		}
+		// Record the outcome in the audit log
+		e := &AuditEntry{Action: AuditSubmit, AppID: job.AppID,
+			SubmissionID: job.SubmissionID, UserID: job.UserID,
+			SourceIP: job.SourceIP, Outcome: AuditSuccess}
+		if failure != "" {
+			e.Outcome = AuditFailure
+			e.Message = failure
+		}
+		if err := AddAuditEntry(db, e); err != nil {
+			log.Printf("(ignored) Failed to record %s audit entry for %s: %v",
+				e.Action, e.AppID, err)
+		}
+	}()
+	if job.Attempts > maxSubmitJobAttempts {
+		failure = fmt.Sprintf("Gave up after %d attempts.",
+			maxSubmitJobAttempts)
+		return
+	}
+	// Keep the heartbeat going while we work, even through long steps
+	// like building the footer.
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(submitJobHeartbeat):
+				db.Exec(fmt.Sprintf("UPDATE %s SET updated = now() "+
+					"WHERE id = $1", submitJobsTable), job.ID)
+			}
+		}
+	}()
+
+	// Wait for any push or other submit for this app to finish, so that
+	// we snapshot a consistent set of files.
+	lock, err := LockApp(db, job.AppID, func() {
+		UpdateSubmitJob(db, job.ID, 0, "waiting")
+	})
+	if err == errAppLockTimeout {
+		failure = err.Error()
+		return
+	} else if err != nil {
+		failure = "Internal error."
+		return
+	}
+	defer lock.Release()
+
+	// If a previous attempt died after making the snapshot, start it
+	// again from scratch.
+	if job.Attempts > 1 {
+		if err := DeleteSnapshot(db, job.AppID, job.SubmissionID); err != nil {
+			failure = "Internal error."
+			return
+		}
+	}
+
+	h, err := newSubmitHandler(job.AppID, job.SubmissionID)
+	if err != nil {
+		failure = "Internal error."
+		return
+	}
+	h.db = db
+	h.job = job
+	h.files = job.Files
+	h.handle()
+	failure = h.failure
+}
+
+// SubmitJobStatus handles the /v1/submit/<app_id>/jobs/<job_id>/ route,
+// returning the job's status. The handshake must be for the same submission.
+func SubmitJobStatus(w http.ResponseWriter, r *http.Request) {
+	appID := context.Get(r, AppIDKey).(string)
+	id, err := strconv.ParseInt(mux.Vars(r)["job_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Job not found.", http.StatusNotFound)
+		return
+	}
+	db := OpenDB()
+	defer db.Close()
+	job, err := GetSubmitJob(db, appID, id)
+	if err != nil {
+		http.Error(w, "Internal error.", 500)
+		return
+	} else if job == nil ||
+		job.SubmissionID != context.Get(r, SubmissionIDKey) {
+		http.Error(w, "Job not found.", http.StatusNotFound)
+		return
+	}
+	job.StatusURL = submitJobStatusURL(appID, job.ID)
+	writeJSON(w, job, http.StatusOK)
+}
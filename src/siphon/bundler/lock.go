@@ -0,0 +1,98 @@
+package bundler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The first key of every advisory lock we take, so that our locks can't
+// collide with anything else using advisory locks on the same database.
+const appLockNamespace = 7001
+
+const defaultAppLockTimeout = 2 * time.Minute
+
+var errAppLockTimeout = errors.New("Timed out waiting for another push or " +
+	"submit to this app to finish. Please try again.")
+
+// AppLock serializes pushes and submits for a single app across every
+// bundler instance, using a postgres advisory lock. The lock belongs to a
+// transaction, so it is released by Release() or if the connection dies.
+type AppLock struct {
+	appID string
+	tx    *sql.Tx
+}
+
+// appLockTimeout returns how long we wait for an app lock, which can be
+// overridden (in seconds) with the APP_LOCK_TIMEOUT environment variable.
+func appLockTimeout() time.Duration {
+	if s := os.Getenv("APP_LOCK_TIMEOUT"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+		log.Printf("(Ignored) Invalid APP_LOCK_TIMEOUT: %s", s)
+	}
+	return defaultAppLockTimeout
+}
+
+// LockApp blocks until we hold the lock for the given app. If somebody else
+// holds it, `queued` is called before we start waiting so that the client
+// can be told. Callers must call AppLock.Release() when they're done.
+func LockApp(db *sql.DB, appID string, queued func()) (*AppLock, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("LockApp() begin error: %v", err)
+		return nil, errors.New("Failed to lock the app.")
+	}
+	l := &AppLock{appID: appID, tx: tx}
+
+	// Try to grab it without waiting first
+	var ok bool
+	err = tx.QueryRow("SELECT pg_try_advisory_xact_lock($1, hashtext($2))",
+		appLockNamespace, appID).Scan(&ok)
+	if err != nil {
+		l.Release()
+		log.Printf("LockApp() try error: %v", err)
+		return nil, errors.New("Failed to lock the app.")
+	} else if ok {
+		return l, nil
+	}
+
+	// Otherwise wait for it, but not forever
+	if queued != nil {
+		queued()
+	}
+	_, err = tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d",
+		appLockTimeout()/time.Millisecond))
+	if err == nil {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1, hashtext($2))",
+			appLockNamespace, appID)
+	}
+	if err != nil {
+		l.Release()
+		if e, ok := err.(*pq.Error); ok && e.Code == "55P03" {
+			return nil, errAppLockTimeout
+		}
+		log.Printf("LockApp() error: %v", err)
+		return nil, errors.New("Failed to lock the app.")
+	}
+	return l, nil
+}
+
+// Release gives up the lock (it is safe to call more than once).
+func (l *AppLock) Release() {
+	if l.tx == nil {
+		return
+	}
+	if err := l.tx.Rollback(); err != nil {
+		log.Printf("(Ignored) AppLock.Release() failed for %s: %v",
+			l.appID, err)
+	}
+	l.tx = nil
+}
@@ -0,0 +1,191 @@
+package bundler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long the URLs in a pull manifest stay valid for
+const manifestURLLifetime = 15 * time.Minute
+
+// PullManifest is returned by a pull with "mode=manifest" instead of a zip.
+// Each file has a signed URL that the client can fetch (and retry)
+// independently; see Files.
+type PullManifest struct {
+	Footer        *ManifestFile   `json:"footer"`
+	AssetsListing []string        `json:"assets_listing"`
+	Assets        []*ManifestFile `json:"assets"`
+	Expires       time.Time       `json:"expires"`
+}
+
+// ManifestFile describes a single file in a PullManifest. Name is where it
+// would have appeared in the zip. For a footer delta, Hash is the hash of
+// the full footer after it's applied.
+type ManifestFile struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	URL  string `json:"url"`
+}
+
+var urlSecret []byte
+var urlSecretOnce sync.Once
+
+// CheckFileURLSecret stops the bundler if FILE_URL_SECRET isn't set. File
+// URLs must work against every instance of the bundler (and after a
+// restart), so they all need to share it. Only tests may run without it.
+func CheckFileURLSecret() {
+	if os.Getenv("FILE_URL_SECRET") == "" &&
+		os.Getenv("SIPHON_ENV") != "testing" {
+		log.Fatal("FILE_URL_SECRET must be set.")
+	}
+}
+
+// fileURLSecret returns the key that file URLs are signed with. In tests,
+// FILE_URL_SECRET may be left unset, in which case we make one up (see
+// CheckFileURLSecret).
+func fileURLSecret() []byte {
+	urlSecretOnce.Do(func() {
+		if s := os.Getenv("FILE_URL_SECRET"); s != "" {
+			urlSecret = []byte(s)
+			return
+		}
+		urlSecret = make([]byte, 32)
+		if _, err := rand.Read(urlSecret); err != nil {
+			log.Fatalf("Failed to generate a file URL secret: %v", err)
+		}
+	})
+	return urlSecret
+}
+
+// signFileParams signs the query parameters of a file URL (url.Values.Encode
+// sorts them, so the order they were added in doesn't matter).
+func signFileParams(appID string, params url.Values) string {
+	mac := hmac.New(sha256.New, fileURLSecret())
+	fmt.Fprintf(mac, "%s\n%s", appID, params.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedFileURL returns a URL that serves a file to anyone until `expires`.
+func signedFileURL(r *http.Request, appID string, params url.Values,
+	expires time.Time) string {
+	params.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	params.Set("signature", signFileParams(appID, params))
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v1/files/%s/?%s", scheme, r.Host,
+		url.QueryEscape(appID), params.Encode())
+}
+
+// writeManifest responds with a PullManifest for the assets and footer
+// worked out by compareAssets and loadBundleFooter.
+func (a *pullArchive) writeManifest(w http.ResponseWriter, r *http.Request) {
+	expires := time.Now().Add(manifestURLLifetime).UTC()
+	manifest := &PullManifest{AssetsListing: a.assetsListingNames(),
+		Assets: []*ManifestFile{}, Expires: expires}
+	fileURL := func(params url.Values) string {
+		if a.submissionID != "" {
+			params.Set("submission_id", a.submissionID)
+		}
+		return signedFileURL(r, a.appID, params, expires)
+	}
+
+	for _, name := range a.sendAssets {
+		hash := a.assetFiles[name]
+		manifest.Assets = append(manifest.Assets, &ManifestFile{
+			Name: path.Join(assetsDir, "images", name),
+			Hash: hash,
+			URL:  fileURL(url.Values{"hash": {hash}}),
+		})
+	}
+
+	params := url.Values{"footer": {a.footerKey}, "hash": {a.footerHash}}
+	if a.clientFooter != "" {
+		params.Set("from", a.clientFooter)
+	}
+	manifest.Footer = &ManifestFile{Name: a.footerName, Hash: a.footerHash,
+		URL: fileURL(params)}
+	writeJSON(w, manifest, http.StatusOK)
+}
+
+// getFooterFile finds the footer stored under `name` with the given hash,
+// which is either the current one or a recent version. It's nil if we no
+// longer have it.
+func getFooterFile(cache *Cache, name string, hash string) []byte {
+	b, err := cache.GetBundleFooter(name)
+	if err == nil && FooterHash(b) == hash {
+		return b
+	}
+	return cache.GetFooterVersion(name, hash)
+}
+
+// Files serves a single file from a pull manifest. Rather than a handshake,
+// the URL carries an expiry time and a signature over its parameters.
+func Files(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["app_id"]
+	r.ParseForm()
+	params := url.Values{}
+	for k, v := range r.Form {
+		if k != "signature" {
+			params[k] = v
+		}
+	}
+	expected := signFileParams(appID, params)
+	if !hmac.Equal([]byte(expected), []byte(r.FormValue("signature"))) {
+		http.Error(w, "Invalid signature.", http.StatusUnauthorized)
+		return
+	}
+	expires, err := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		http.Error(w, "This URL has expired.", http.StatusForbidden)
+		return
+	}
+
+	cache, err := NewCache(appID, r.FormValue("submission_id"))
+	if err != nil {
+		log.Printf("[Files() NewCache error] %v", err)
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+
+	var b []byte
+	if footer := r.FormValue("footer"); footer != "" {
+		// A footer, or a delta against the client's footer
+		b = getFooterFile(cache, footer, r.FormValue("hash"))
+		if from := r.FormValue("from"); b != nil && from != "" {
+			if old := getFooterFile(cache, footer, from); old != nil {
+				b = MakeDelta(old, b)
+			} else {
+				b = nil
+			}
+		}
+		if b == nil {
+			http.Error(w, "This footer has been replaced, pull again.",
+				http.StatusGone)
+			return
+		}
+	} else {
+		b, err = cache.Get(r.FormValue("hash"))
+		if err != nil {
+			log.Printf("[Files() cache error] %v", err)
+			http.Error(w, "File not found.", http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
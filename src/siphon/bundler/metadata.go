@@ -4,12 +4,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 // The file in an app directory where we expect to find the metadata
 const MetadataName string = "Siphonfile"
 
+// DefaultAssetExtensions are the file types that are sent to devices as
+// assets (in __siphon_assets/) unless the Siphonfile's "asset_extensions"
+// key says otherwise.
+var DefaultAssetExtensions = []string{
+	".png", ".jpg", ".jpeg", ".gif", ".psd", ".svg", ".webp", // images
+	".ttf", ".otf", // fonts
+	".mp3", ".wav", ".aac", ".m4a", ".ogg", // audio
+	".mp4", ".mov", ".webm", // video
+}
+
+const maxAssetExtensions = 64
+
+var assetExtensionRegexp = regexp.MustCompile(`^\.[A-Za-z0-9]{1,16}$`)
+
+// PlatformMetadata is a platform's section of the Siphonfile, e.g. "ios"
 type PlatformMetadata struct {
 	Language  string `json:"language"`
 	StoreName string `json:"store_name"`
@@ -18,11 +35,39 @@ type PlatformMetadata struct {
 // Metadata represents the parsed content of a Siphonfile and Publish
 // directory
 type Metadata struct {
-	BaseVersion   string           `json:"base_version"`
-	DisplayName   string           `json:"display_name"`
-	FacebookAppID string           `json:"facebook_app_id"`
-	IOS           PlatformMetadata `json:"ios"`
-	Android       PlatformMetadata `json:"android"`
+	BaseVersion   string `json:"base_version"`
+	DisplayName   string `json:"display_name"`
+	FacebookAppID string `json:"facebook_app_id"`
+
+	AssetExtensions []string `json:"asset_extensions"`
+	Platforms       []string `json:"platforms"`
+
+	// Keyed by platform name, see Section()
+	sections map[string]PlatformMetadata
+}
+
+// Section returns the platform's section of the Siphonfile, which is empty
+// if it's missing.
+func (m *Metadata) Section(platform string) PlatformMetadata {
+	return m.sections[platform]
+}
+
+// Assets returns the file extensions (e.g. ".png") that should be treated
+// as assets for this app.
+func (m *Metadata) Assets() []string {
+	if m == nil || len(m.AssetExtensions) == 0 {
+		return DefaultAssetExtensions
+	}
+	return m.AssetExtensions
+}
+
+// DeclaredPlatforms returns the platforms the app is built for, which is
+// all of them unless the "platforms" key says otherwise.
+func (m *Metadata) DeclaredPlatforms() []string {
+	if m == nil || len(m.Platforms) == 0 {
+		return PlatformNames()
+	}
+	return m.Platforms
 }
 
 // ParseMetadata loads a raw Siphonfile, parses it from JSON and checks
@@ -63,28 +108,59 @@ func ParseMetadata(b []byte) (metadata *Metadata, err error) {
 			MetadataName)
 	}
 
-	// Validate the optional iOS metadata
-	if len(m.IOS.StoreName) > 255 {
-		return nil, fmt.Errorf(`The iOS "store_name" key in your %s is too `+
-			`long. The maximum is 255 characters.`,
-			MetadataName)
-	}
-	if len(m.IOS.Language) > 7 {
-		return nil, fmt.Errorf(`The iOS "language" key in your %s is too `+
-			`long. The maximum is 7 characters.`,
-			MetadataName)
+	// Validate the optional platform-specific metadata
+	var raw map[string]json.RawMessage
+	json.Unmarshal(b, &raw)
+	m.sections = map[string]PlatformMetadata{}
+	for _, p := range Platforms() {
+		var section PlatformMetadata
+		if j, ok := raw[p.Name]; ok {
+			if err := json.Unmarshal(j, &section); err != nil {
+				return nil, fmt.Errorf(`The %q key in your %s is invalid. `+
+					`Please check the documentation.`, p.Name, MetadataName)
+			}
+		}
+		if len(section.StoreName) > p.MaxStoreName {
+			return nil, fmt.Errorf(`The %s "store_name" key in your %s is `+
+				`too long. The maximum is %d characters.`,
+				p.Title, MetadataName, p.MaxStoreName)
+		}
+		if len(section.Language) > 7 {
+			return nil, fmt.Errorf(`The %s "language" key in your %s is too `+
+				`long. The maximum is 7 characters.`,
+				p.Title, MetadataName)
+		}
+		m.sections[p.Name] = section
 	}
 
-	// Validate the optional Android metadata
-	if len(m.Android.StoreName) > 30 {
-		return nil, fmt.Errorf(`The Android "store_name" key in your %s is too `+
-			`long. The maximum is 30 characters.`,
-			MetadataName)
+	// Validate the optional "asset_extensions" key, which replaces the
+	// default list. A missing leading "." is added for convenience.
+	if len(m.AssetExtensions) > maxAssetExtensions {
+		return nil, fmt.Errorf(`The "asset_extensions" key in your %s has `+
+			`too many entries. The maximum is %d.`, MetadataName,
+			maxAssetExtensions)
 	}
-	if len(m.Android.Language) > 7 {
-		return nil, fmt.Errorf(`The Android "language" key in your %s is too `+
-			`long. The maximum is 7 characters.`,
-			MetadataName)
+	for i, ext := range m.AssetExtensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !assetExtensionRegexp.MatchString(ext) {
+			return nil, fmt.Errorf(`The "asset_extensions" key in your %s `+
+				`contains an invalid extension %q. It should be a list of `+
+				`strings like [".png", ".ttf"].`, MetadataName,
+				m.AssetExtensions[i])
+		}
+		m.AssetExtensions[i] = ext
+	}
+
+	// Validate the optional "platforms" key
+	for _, p := range m.Platforms {
+		if _, err := GetPlatform(p); err != nil {
+			names, _ := json.Marshal(PlatformNames())
+			return nil, fmt.Errorf(`The "platforms" key in your %s contains `+
+				`an unknown platform %q. It should be a list like %s.`,
+				MetadataName, p, names)
+		}
 	}
 
 	return &m, nil
@@ -17,8 +17,11 @@ var (
 
 // PostAppUpdated sends an app_updated notification on the app notification
 // exchange so that the Siphon Sandbox, simulator or developer device can
-// refresh itself accordingly.
+// refresh itself accordingly. Clients of /v1/events/ hear about it too,
+// whether or not RabbitMQ is available.
 func PostAppUpdated(appID string, userID string) {
+	PublishAppEvent(appID, EventAppUpdated, userID, "")
+
 	log.Printf("Dialing %s", amqpURI)
 	conn, err := amqp.Dial(amqpURI)
 	if err != nil {
@@ -15,37 +15,28 @@ import (
 	"strings"
 )
 
-// FooterPath holds packager json output
-type FooterPath struct {
-	IOS     string `json:"ios"`
-	Android string `json:"android"`
-}
+// FooterPath holds packager json output, i.e. the path of each platform's
+// footer keyed by the platform's name.
+type FooterPath map[string]string
 
-// CleanupFooters takes a FooterPath struct and erases the appropriate
-// directory (the footers are both saved in the same tmp directory)
-func CleanupFooters(f *FooterPath) {
-	if f.IOS != "" && strings.Contains(f.IOS, "siphon-packager-tmp-") {
-		d := filepath.Dir(f.IOS)
-		if !strings.Contains(d, "siphon-packager-tmp-") {
-			log.Printf("(Ignored) footer cleanup failed: Invalid directory")
-			return
-		}
-		if err := os.RemoveAll(d); err != nil {
-			log.Printf("(Ignored) footer cleanup failed: %v", err)
+// CleanupFooters takes a FooterPath and erases the appropriate directories
+// (the footers are usually saved in the same tmp directory, but not when
+// each platform was built separately)
+func CleanupFooters(f FooterPath) {
+	dirs := map[string]bool{}
+	for _, p := range f {
+		if p != "" {
+			dirs[filepath.Dir(p)] = true
 		}
-		return
 	}
-
-	if f.Android != "" {
-		d := filepath.Dir(f.Android)
-		if !strings.Contains(f.Android, "siphon-packager-tmp-") {
+	for d := range dirs {
+		if !strings.Contains(d, "siphon-packager-tmp-") {
 			log.Printf("(Ignored) footer cleanup failed: Invalid directory")
-			return
+			continue
 		}
 		if err := os.RemoveAll(d); err != nil {
 			log.Printf("(Ignored) footer cleanup failed: %v", err)
 		}
-		return
 	}
 }
 
@@ -55,27 +46,45 @@ func cleanup(d string) {
 	}
 }
 
-func MakeBundleFooters(d string, baseVersion string) (f *FooterPath,
-	err error) {
+// MakeBundleFooters runs the packager against the app files in `d`, using
+// the base version and asset types from the app's `metadata`. Only the
+// footers for `platforms` are built.
+func MakeBundleFooters(d string, metadata *Metadata,
+	platforms []*Platform) (f FooterPath, err error) {
 	// Build the footer and cleanup
 	if os.Getenv("SIPHON_ENV") == "testing" {
 		// Create dummy footer files
 		tmpDir, err := ioutil.TempDir("", "siphon-packager-tmp-")
-		iosFooter := path.Join(tmpDir, "bundle-footer-ios")
-		androidFooter := path.Join(tmpDir, "bundle-footer-android")
-		txt := "Dummy bundle footer for testing."
-		os.MkdirAll(filepath.Dir(iosFooter), 0600) // make any intermediate dirs
-		if ioutil.WriteFile(iosFooter, []byte(txt), 0600); err != nil {
-			cleanup(tmpDir)
+		if err != nil {
 			return nil, err
 		}
-		if ioutil.WriteFile(androidFooter, []byte(txt), 0600); err != nil {
-			cleanup(tmpDir)
-			return nil, err
+		f = FooterPath{}
+		for _, p := range platforms {
+			// The platform's entry file (index.ios.js, or else index.js)
+			// is included so that tests can make footers that differ
+			// between pushes and platforms (e.g. to get a delta on pull).
+			txt := "Dummy bundle footer for testing."
+			for _, name := range []string{"index." + p.Name + ".js",
+				"index.js"} {
+				b, err := ioutil.ReadFile(path.Join(d, name))
+				if err == nil {
+					txt += "\n" + string(b)
+					break
+				}
+			}
+			footer := path.Join(tmpDir, p.FooterKey())
+			if err := ioutil.WriteFile(footer, []byte(txt), 0600); err != nil {
+				cleanup(tmpDir)
+				return nil, err
+			}
+			f[p.Name] = footer
 		}
-		f = &FooterPath{IOS: iosFooter, Android: androidFooter}
 	} else {
-		b, err := packager(d, baseVersion)
+		names := []string{}
+		for _, p := range platforms {
+			names = append(names, p.Name)
+		}
+		b, err := packager(d, metadata.BaseVersion, metadata.Assets(), names)
 		if err != nil {
 			return nil, err
 		}
@@ -84,16 +93,52 @@ func MakeBundleFooters(d string, baseVersion string) (f *FooterPath,
 			return nil, err
 		}
 	}
-	// Return the FooterPath struct pointer
+	for _, p := range platforms {
+		if f[p.Name] == "" {
+			CleanupFooters(f)
+			return nil, fmt.Errorf("Problem building footer for %s.",
+				p.Title)
+		}
+	}
+	// Return the FooterPath
 	return f, nil
 }
 
-// MakeBundleFootersTmp spins up a temporary directory and writes all of the app
-// files there. If `archive` is not nil, it will attempt to grab the files
-// from there first (much faster).
+// MakePlatformFooters builds the footers for `files`, which have already
+// been copied into `d`. If any of them are platform-specific (see
+// PlatformFiles), each platform is built separately, and only for itself,
+// from its own copy of `d` so that it only sees its own variants.
+func MakePlatformFooters(d string, files map[string]string,
+	metadata *Metadata) (f FooterPath, err error) {
+	if !HasPlatformFiles(files) {
+		return MakeBundleFooters(d, metadata, Platforms())
+	}
+	f = FooterPath{}
+	for _, p := range Platforms() {
+		pd, err := CopyFilesToTemp(d, PlatformFiles(files, p.Name))
+		if err != nil {
+			CleanupFooters(f)
+			return nil, err
+		}
+		pf, err := MakeBundleFooters(pd, metadata, []*Platform{p})
+		Cleanup(pd)
+		if err != nil {
+			CleanupFooters(f)
+			return nil, err
+		}
+		f[p.Name] = pf[p.Name]
+	}
+	return f, nil
+}
+
+// MakeBundleFootersTmp spins up a temporary directory and writes `files`
+// (name -> SHA-256 hash) there, or all of the app's latest files if `files`
+// is nil. If `archive` is not nil, it will attempt to grab the files from
+// there first (much faster).
 // (convenenience function for the same purpose as above)
 func MakeBundleFootersTmp(db *sql.DB, appID string, submissionID string,
-	archive *Archive, baseVersion string) (f *FooterPath, err error) {
+	files map[string]string, archive *Archive, metadata *Metadata) (
+	f FooterPath, err error) {
 	// We need the cache for files that do not exist in the Archive (which
 	// is probably  most of them).
 	cache, err := NewCache(appID, submissionID)
@@ -101,9 +146,11 @@ func MakeBundleFootersTmp(db *sql.DB, appID string, submissionID string,
 		return nil, err
 	}
 	// Get the very latest files for this app
-	files, err := GetFiles(db, appID, submissionID)
-	if err != nil {
-		return nil, err
+	if files == nil {
+		files, err = GetFiles(db, appID, submissionID)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	d, err := FilesToTemp(files, db, archive, cache)
@@ -111,7 +158,7 @@ func MakeBundleFootersTmp(db *sql.DB, appID string, submissionID string,
 		return nil, err
 	}
 
-	f, err = MakeBundleFooters(d, baseVersion)
+	f, err = MakePlatformFooters(d, files, metadata)
 	if err != nil {
 		Cleanup(d)
 		return nil, err
@@ -120,13 +167,20 @@ func MakeBundleFootersTmp(db *sql.DB, appID string, submissionID string,
 	return f, nil
 }
 
-// Only generates the footer for now
-func packager(projectPath string, baseVersion string) (b []byte, err error) {
+// Only generates the footer for now. The asset extensions are passed in the
+// SIPHON_ASSET_EXTENSIONS environment variable (comma-separated), so that
+// the packager treats the same files as assets as /pull does, and the
+// platforms to build footers for are passed in SIPHON_PLATFORMS (likewise).
+func packager(projectPath string, baseVersion string, assetExts []string,
+	platforms []string) (b []byte, err error) {
 	prefix := "source $NVM_DIR/nvm.sh && "
 	c := fmt.Sprintf("siphon-packager.py --footer --project-path %s "+
 		"--base-version %s --minify", projectPath, baseVersion)
 	log.Printf("PACKAGING: %s", c)
 	cmd := exec.Command("bash", "-c", prefix+c)
+	cmd.Env = append(os.Environ(),
+		"SIPHON_ASSET_EXTENSIONS="+strings.Join(assetExts, ","),
+		"SIPHON_PLATFORMS="+strings.Join(platforms, ","))
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
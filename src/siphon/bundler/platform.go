@@ -0,0 +1,165 @@
+package bundler
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// LegacyFooterKey is where footers were stored before Android support.
+// Pulls still fall back to it for apps that haven't been pushed since.
+const LegacyFooterKey = "bundle-footer"
+
+// Platform describes a target that apps are built for. Supporting a new
+// one (e.g. tvOS) means registering a Platform in init() below, as long as
+// the packager knows how to build it too.
+type Platform struct {
+	// Name identifies the platform in "platform" parameters, the
+	// packager's output, Siphonfile sections (e.g. "ios": {...}) and
+	// platform-specific file names (e.g. "Button.ios.js").
+	Name string
+	// Title is how we refer to the platform in messages, e.g. "iOS"
+	Title string
+	// IconsDir holds the app's icons for this platform
+	IconsDir string
+	// MaxStoreName is the longest "store_name" the store allows
+	MaxStoreName int
+	// The fields of the metadata PUT to the web app (see putMetadata) that
+	// the Siphonfile's "store_name" and "language" keys go in.
+	StoreNameField     string
+	StoreLanguageField string
+}
+
+// FooterKey returns the cache key for the platform's bundle footer.
+func (p *Platform) FooterKey() string {
+	return fmt.Sprintf("bundle-footer-%s", p.Name)
+}
+
+var platforms = []*Platform{}
+
+var errUnknownPlatform = errors.New("Unknown platform.")
+
+// RegisterPlatform adds a platform that apps can be built for.
+func RegisterPlatform(p *Platform) {
+	platforms = append(platforms, p)
+}
+
+func init() {
+	RegisterPlatform(&Platform{
+		Name:               "ios",
+		Title:              "iOS",
+		IconsDir:           "publish/ios/icons",
+		MaxStoreName:       255,
+		StoreNameField:     "app_store_name",
+		StoreLanguageField: "app_store_language",
+	})
+	RegisterPlatform(&Platform{
+		Name:               "android",
+		Title:              "Android",
+		IconsDir:           "publish/android/icons",
+		MaxStoreName:       30,
+		StoreNameField:     "play_store_name",
+		StoreLanguageField: "play_store_language",
+	})
+}
+
+// Platforms returns every registered platform.
+func Platforms() []*Platform {
+	return platforms
+}
+
+// PlatformNames returns the names of every registered platform.
+func PlatformNames() []string {
+	names := []string{}
+	for _, p := range platforms {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// GetPlatform looks up a platform by name.
+func GetPlatform(name string) (*Platform, error) {
+	for _, p := range platforms {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, errUnknownPlatform
+}
+
+// RequestedPlatform returns the platform named by the "platform" parameter,
+// which defaults to iOS.
+func RequestedPlatform(name string) (*Platform, error) {
+	if name == "" {
+		name = "ios"
+	}
+	return GetPlatform(name)
+}
+
+// filePlatform returns the platform a file like "Button.ios.js" is specific
+// to, along with the name it stands in for ("Button.js"). The platform is
+// empty for files that aren't platform-specific.
+func filePlatform(name string) (platform string, base string) {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for _, p := range platforms {
+		if strings.HasSuffix(stem, "."+p.Name) {
+			return p.Name, strings.TrimSuffix(stem, "."+p.Name) + ext
+		}
+	}
+	return "", name
+}
+
+// HasPlatformFiles reports whether any of `files` are platform-specific.
+func HasPlatformFiles(files map[string]string) bool {
+	for name := range files {
+		if p, _ := filePlatform(name); p != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// PlatformFiles returns the files needed for `platform`, i.e. without any
+// that are specific to other platforms.
+func PlatformFiles(files map[string]string,
+	platform string) map[string]string {
+	filtered := map[string]string{}
+	for name, hash := range files {
+		if p, _ := filePlatform(name); p == "" || p == platform {
+			filtered[name] = hash
+		}
+	}
+	return filtered
+}
+
+// PlatformWarnings describes the platform-specific files in `names` that
+// have no counterpart for one of the `declared` platforms, i.e. neither
+// that platform's variant nor a file without a platform suffix. Those
+// builds would fail to find the file.
+func PlatformWarnings(names []string, declared []string) []string {
+	exists := map[string]bool{}
+	for _, name := range names {
+		exists[name] = true
+	}
+	warnings := []string{}
+	for _, name := range names {
+		p, base := filePlatform(name)
+		if p == "" || exists[base] {
+			continue
+		}
+		ext := path.Ext(base)
+		for _, other := range declared {
+			variant := strings.TrimSuffix(base, ext) + "." + other + ext
+			if other != p && !exists[variant] {
+				warnings = append(warnings, fmt.Sprintf("%s has no %s "+
+					"counterpart (expected %s or %s).", name, other,
+					variant, base))
+			}
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
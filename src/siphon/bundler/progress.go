@@ -0,0 +1,202 @@
+package bundler
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// NDJSONContentType is the media type a client should send in its Accept
+// header to receive push progress as newline-delimited JSON events.
+const NDJSONContentType = "application/x-ndjson"
+
+// ProgressEvent is a single line of an NDJSON progress stream. The "type"
+// is one of "phase", "file", "warning", "error" or "done".
+type ProgressEvent struct {
+	Type    string      `json:"type"`
+	Phase   string      `json:"phase,omitempty"`
+	Action  string      `json:"action,omitempty"` // see File()
+	Name    string      `json:"name,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Fatal   bool        `json:"fatal,omitempty"`
+	Result  *PushResult `json:"result,omitempty"` // only for "done"
+}
+
+// PushResult summarises a push, it is sent with the final "done" event.
+type PushResult struct {
+	Success  bool          `json:"success"`
+	DryRun   bool          `json:"dry_run"`
+	Revision string        `json:"revision,omitempty"`
+	Added    []string      `json:"added"`
+	Changed  []string      `json:"changed"`
+	Removed  []string      `json:"removed"`
+	Ignored  []string      `json:"ignored"`
+	Warnings []string      `json:"warnings"`
+	Errors   []string      `json:"errors"`
+	Conflict *RevisionDiff `json:"conflict,omitempty"`
+}
+
+// Progress streams the progress of a push back to the client. By default
+// it writes the traditional "siphon: ..." text lines, but if the client
+// asked for NDJSON it writes one ProgressEvent per line instead.
+type Progress struct {
+	w       http.ResponseWriter
+	json    bool
+	started bool // true once we've written to the response
+	done    bool
+	result  PushResult
+}
+
+// wantsNDJSON returns true if the request's Accept header lists the NDJSON
+// media type.
+func wantsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && (t == NDJSONContentType || t == "application/ndjson") {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProgress negotiates the progress format for the given request.
+func NewProgress(w http.ResponseWriter, r *http.Request) *Progress {
+	p := &Progress{w: w, json: wantsNDJSON(r)}
+	p.result.Added = []string{}
+	p.result.Changed = []string{}
+	p.result.Removed = []string{}
+	p.result.Ignored = []string{}
+	p.result.Warnings = []string{}
+	p.result.Errors = []string{}
+	if p.json {
+		w.Header().Set("Content-Type", NDJSONContentType)
+	}
+	return p
+}
+
+func (p *Progress) event(e *ProgressEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[Progress.event() marshal error] %v", err)
+		return
+	}
+	p.started = true
+	p.w.Write(append(b, '\n'))
+	if f, ok := p.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Phase signals the start of a new phase of the push (e.g. "decompress").
+func (p *Progress) Phase(phase string, msg string) {
+	if p.json {
+		p.event(&ProgressEvent{Type: "phase", Phase: phase, Message: msg})
+	} else {
+		BufferLine(p.w, msg)
+	}
+}
+
+// File signals that a file was processed, where `action` is one of "add",
+// "update", "remove" or "ignore".
+func (p *Progress) File(action string, name string) {
+	if p.json {
+		p.event(&ProgressEvent{Type: "file", Action: action, Name: name})
+	} else if action == "ignore" {
+		BufferLine(p.w, "Ignored: "+name)
+	} else if p.result.DryRun {
+		BufferLine(p.w, "Would "+action+": "+name)
+	} else {
+		BufferLine(p.w, "--> "+name)
+	}
+}
+
+// Note writes an informational line in text mode. NDJSON clients get the
+// same information from the final result, so nothing is sent to them.
+func (p *Progress) Note(msg string) {
+	if !p.json {
+		BufferLine(p.w, msg)
+	}
+}
+
+// Warning reports something the user should know about, but which does not
+// stop the push.
+func (p *Progress) Warning(msg string) {
+	p.result.Warnings = append(p.result.Warnings, msg)
+	if p.json {
+		p.event(&ProgressEvent{Type: "warning", Message: msg})
+	} else {
+		BufferLine(p.w, "[WARNING] "+msg)
+	}
+}
+
+// Error reports a non-fatal error (e.g. a validation error during a
+// dry run). Use Fail() to abort the push.
+func (p *Progress) Error(msg string) {
+	p.result.Errors = append(p.result.Errors, msg)
+	if p.json {
+		p.event(&ProgressEvent{Type: "error", Message: msg})
+	} else {
+		BufferLine(p.w, "[ERROR] "+msg)
+	}
+}
+
+// Fail reports a fatal, user-facing error and finishes the stream.
+func (p *Progress) Fail(msg string) {
+	p.fail(msg, "[ERROR] "+msg, 500)
+}
+
+// InternalError reports a fatal error that is not suitable for showing to
+// the user and finishes the stream.
+func (p *Progress) InternalError() {
+	p.fail("Internal error.", "Internal error.", 500)
+}
+
+// Conflict rejects the push because the app has changed since the revision
+// the client based it on. The `diff` lists what changed since then, or is
+// nil if we have no record of that revision.
+func (p *Progress) Conflict(msg string, diff *RevisionDiff) {
+	p.result.Conflict = diff
+	text := "[ERROR] " + msg
+	if diff != nil {
+		text += "\n" + diff.String()
+	}
+	p.fail(msg, text, http.StatusConflict)
+}
+
+// In text mode, `text` is written with http.Error() as it always has been.
+// In NDJSON mode the status `code` is only used if nothing has been
+// streamed yet.
+func (p *Progress) fail(msg string, text string, code int) {
+	p.result.Success = false
+	p.result.Errors = append(p.result.Errors, msg)
+	if !p.json {
+		http.Error(p.w, text, code)
+		return
+	}
+	if !p.started {
+		p.w.WriteHeader(code)
+	}
+	p.event(&ProgressEvent{Type: "error", Message: msg, Fatal: true})
+	p.finish("")
+}
+
+// Done finishes the stream successfully (unless Error() was called) with
+// a final message.
+func (p *Progress) Done(msg string) {
+	p.result.Success = len(p.result.Errors) == 0
+	if !p.json {
+		BufferLine(p.w, msg)
+		return
+	}
+	p.finish(msg)
+}
+
+func (p *Progress) finish(msg string) {
+	if p.done {
+		return
+	}
+	p.done = true
+	p.event(&ProgressEvent{Type: "done", Message: msg, Result: &p.result})
+}
@@ -2,6 +2,7 @@ package bundler
 
 import (
 	"archive/zip"
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -10,9 +11,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"path"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/context"
@@ -20,64 +21,108 @@ import (
 
 const assetsListingFile string = "assets-listing"
 const assetsDir string = "__siphon_assets" // dir written to in the zip
-var assetsLike []string = []string{"%.png", "%.jpg", "%.jpeg",
-																 "%.gif", "%.psd", "%.svg", "%.webp"}
+
+// Written instead of "bundle-footer" when the client told us which footer it
+// has and we could send a delta against it (see ApplyDelta).
+const footerDeltaFile string = "bundle-footer.delta"
 
 var errAppEmpty = errors.New("This app has not been pushed yet.")
 
+// Assets with these extensions are already compressed, so we store them in
+// the zip as-is rather than wasting time deflating them again.
+var storedExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp",
+	".mp3", ".m4a", ".aac", ".ogg", ".mp4", ".mov"}
+
+var errClientGone = errors.New("Client disconnected.")
+
 type pullArchive struct {
 	appID        string
 	submissionID string
-	tempDir      string
+	assetExts    []string // see Metadata.Assets()
 	assetFiles   map[string]string
+	sendAssets   []string // names of assets the client needs, sorted
+	footerName   string   // "bundle-footer" or footerDeltaFile
+	footer       []byte
+	footerKey    string // the footer's cache key
+	footerHash   string // hash of the full (not delta) footer
+	clientFooter string // hash the delta (if any) is against
 	cache        *Cache
 }
 
 func newPullArchive(appID string, submissionID string) (pa *pullArchive,
 	err error) {
-	// Make our temporary directory
-	d, err := ioutil.TempDir("", "pull-archive")
-	if err != nil {
-		return nil, err
-	}
 	cache, err := NewCache(appID, submissionID)
 	if err != nil {
 		return nil, err
 	}
-	a := pullArchive{appID: appID, submissionID: submissionID,
-		tempDir: d, cache: cache}
+	a := pullArchive{appID: appID, submissionID: submissionID, cache: cache}
 	return &a, nil
 }
 
-func (a *pullArchive) getAssetFiles(db *sql.DB) error {
-	f, err := GetSliceFilteredFiles(db, a.appID, a.submissionID, assetsLike)
+// loadAssetExtensions reads the asset types from the app's Siphonfile. If
+// that fails for some reason, we fall back to the defaults.
+func (a *pullArchive) loadAssetExtensions(db *sql.DB) {
+	a.assetExts = DefaultAssetExtensions
+	hash, err := GetFile(db, a.appID, a.submissionID, MetadataName)
+	if err != nil {
+		log.Printf("(Ignored) loadAssetExtensions() GetFile error: %v", err)
+		return
+	}
+	b, err := a.cache.Get(hash)
+	if err != nil {
+		log.Printf("(Ignored) loadAssetExtensions() cache error: %v", err)
+		return
+	}
+	metadata, err := ParseMetadata(b)
+	if err != nil {
+		log.Printf("(Ignored) loadAssetExtensions() parse error: %v", err)
+		return
+	}
+	a.assetExts = metadata.Assets()
+}
+
+// getAssetFiles loads the assets a pull for `platform` needs, leaving out
+// other platforms' variants (see PlatformFiles).
+func (a *pullArchive) getAssetFiles(db *sql.DB, platform string) error {
+	like := []string{}
+	for _, ext := range a.assetExts {
+		like = append(like, "%"+ext)
+	}
+	f, err := GetSliceFilteredFiles(db, a.appID, a.submissionID, like)
 	if err != nil {
 		return err
 	}
-	a.assetFiles = f
+	a.assetFiles = PlatformFiles(f, platform)
 	return nil
 }
 
-func (a *pullArchive) writeAssetsListing() error {
-	// Write out the assets-listing file into our temporary directory
-	f, _ := os.Create(path.Join(a.tempDir, assetsListingFile))
-	defer f.Close()
-
+// assetsListingNames returns the sorted names in the assets-listing file.
+func (a *pullArchive) assetsListingNames() []string {
+	names := []string{}
 	for name := range a.assetFiles {
 		// The original path (e.g. "components/bananas.png") is prefixed with
 		// "images/<path>" to match the client's __siphon_assets/ directory
-		fil := path.Join("images", name) + "\n"
-		if _, err := f.WriteString(fil); err != nil {
-			return err
-		}
+		names = append(names, path.Join("images", name))
 	}
-	return nil
+	sort.Strings(names)
+	return names
 }
 
-// WriteAssets adds any assets that the client does not have (or assets that
-// have changed) into the __siphon_assets/images/ directory in this archive. It
-// compares the given `assetHashes` with those stored by the server.
-func (a *pullArchive) writeAssets(assetHashes map[string]string) error {
+// assetsListing returns the contents of the assets-listing file.
+func (a *pullArchive) assetsListing() []byte {
+	var buf bytes.Buffer
+	for _, name := range a.assetsListingNames() {
+		buf.WriteString(name + "\n")
+	}
+	return buf.Bytes()
+}
+
+// compareAssets works out which assets the client does not have (or assets
+// that have changed), to go in the __siphon_assets/images/ directory of this
+// archive. It compares the given `assetHashes` with those stored by the
+// server.
+func (a *pullArchive) compareAssets(assetHashes map[string]string) {
+	a.sendAssets = []string{}
 	for name, hash := range a.assetFiles {
 		// If the client does not have this asset (i.e. the name is not
 		// present in the hashes they sent us) or the client's SHA-256 hash
@@ -85,67 +130,131 @@ func (a *pullArchive) writeAssets(assetHashes map[string]string) error {
 		prefixedName := path.Join("images", name) // as it appears in hashes
 		clientSha, ok := assetHashes[prefixedName]
 		if !ok || clientSha != hash {
-			b, err := a.cache.Get(hash)
-			if err != nil {
-				return err
-			}
-			p := path.Join(a.tempDir, assetsDir, prefixedName)
+			a.sendAssets = append(a.sendAssets, name)
+		}
+	}
+	sort.Strings(a.sendAssets)
+}
 
-			// Make intermediate dirs then write the asset fil
-			if err = os.MkdirAll(filepath.Dir(p), 0700); err != nil {
-				log.Printf("[writeAssets() MkdirAll error] %v", err)
-				return err
-			}
-			if err = ioutil.WriteFile(p, b, 0700); err != nil {
-				log.Printf("[writeAssets() WriteFile error] %v", err)
-				return err
-			}
+// selectDensities drops image variants that a screen at `scale` doesn't
+// need from the assets we're sending. Note that this is decided from all of
+// the assets, so a client that already has the best variant of an image
+// isn't sent another.
+func (a *pullArchive) selectDensities(scale float64) {
+	names := []string{}
+	for name := range a.assetFiles {
+		names = append(names, name)
+	}
+	selected := SelectDensities(names, scale)
+	send := []string{}
+	for _, name := range a.sendAssets {
+		if selected[name] {
+			send = append(send, name)
 		}
 	}
-	return nil
+	a.sendAssets = send
 }
 
-func (a *pullArchive) writeBundleFooter(platform string) error {
-	b, err := a.cache.GetBundleFooter(BundleFooterFile(platform))
+// legacyFooterPlatform returns the platform whose footer may be stored
+// under LegacyFooterKey: apps pushed before Android support only had an
+// iOS footer there, whereas submissions made before every platform was
+// built on submit stored their Android footer there.
+func legacyFooterPlatform(submissionID string) string {
+	if submissionID == "" {
+		return "ios"
+	}
+	return "android"
+}
+
+// loadBundleFooter fetches the footer for `platform`, preferring a delta
+// against the client's footer where that's smaller.
+func (a *pullArchive) loadBundleFooter(platform *Platform,
+	footerHash string) error {
+	name := platform.FooterKey()
+	b, err := a.cache.GetBundleFooter(name)
 
 	// If we encounter an error, then we check for an old-style bundle footer
-	// (user may have pushed their app before Android support)
-	if err != nil {
-		b, err = a.cache.GetBundleFooter("bundle-footer")
+	// (see legacyFooterPlatform)
+	if err != nil && platform.Name == legacyFooterPlatform(a.submissionID) {
+		name = LegacyFooterKey
+		b, err = a.cache.GetBundleFooter(name)
 		if err != nil {
 			return err
 		}
 	}
+	a.footerName, a.footer = "bundle-footer", b
+	a.footerKey, a.footerHash = name, FooterHash(b)
 
-	p := path.Join(a.tempDir, "bundle-footer")
-	if err = ioutil.WriteFile(p, b, 0600); err != nil {
-		return err
+	// If the client has a footer we still know about, a delta against it
+	// is usually far smaller than the whole thing.
+	if footerHash != "" {
+		var old []byte
+		if footerHash == a.footerHash {
+			old = b
+		} else {
+			old = a.cache.GetFooterVersion(name, footerHash)
+		}
+		if old != nil {
+			delta := MakeDelta(old, b)
+			if len(delta) < len(b) {
+				a.footerName, a.footer = footerDeltaFile, delta
+				a.clientFooter = footerHash
+			}
+		}
 	}
 	return nil
 }
 
-func (a *pullArchive) writeZip(w http.ResponseWriter) error {
-	w.Header().Set("Content-Type", "application/zip")
-	zw := zip.NewWriter(w)
-	defer zw.Close()
-	err := filepath.Walk(a.tempDir, func(path string, info os.FileInfo,
-		err error) error {
-		if !info.IsDir() {
-			p := strings.Replace(path, a.tempDir+"/", "", 1)
-			f, err := zw.Create(p)
-			src, err := os.Open(path)
-			_, err = io.Copy(f, src)
-			src.Close()
-			if err != nil {
-				return err
-			}
+func isStored(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range storedExtensions {
+		if ext == e {
+			return true
 		}
-		return nil
-	})
+	}
+	return false
+}
+
+func writeZipEntry(zw *zip.Writer, name string, b []byte) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	if isStored(name) {
+		header.Method = zip.Store
+	}
+	f, err := zw.CreateHeader(header)
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = f.Write(b)
+	return err
+}
+
+// writeZip streams the archive to the client, fetching each asset from the
+// cache as it goes. It stops early if `closed` fires (i.e. the client went
+// away); `closed` may be nil.
+func (a *pullArchive) writeZip(w io.Writer, closed <-chan struct{}) error {
+	zw := zip.NewWriter(w)
+	for _, name := range a.sendAssets {
+		select {
+		case <-closed:
+			return errClientGone
+		default:
+		}
+		b, err := a.cache.Get(a.assetFiles[name])
+		if err != nil {
+			return err
+		}
+		p := path.Join(assetsDir, "images", name)
+		if err = writeZipEntry(zw, p, b); err != nil {
+			return err
+		}
+	}
+	if err := writeZipEntry(zw, assetsListingFile, a.assetsListing()); err != nil {
+		return err
+	}
+	if err := writeZipEntry(zw, a.footerName, a.footer); err != nil {
+		return err
+	}
+	return zw.Close()
 }
 
 func (a *pullArchive) assertNotEmpty(db *sql.DB) error {
@@ -158,30 +267,30 @@ func (a *pullArchive) assertNotEmpty(db *sql.DB) error {
 	return nil
 }
 
-func (a *pullArchive) close() {
-	// Clean up our temporary directory
-	if err := os.RemoveAll(a.tempDir); err != nil {
-		log.Printf("(Ignored) pullArchive() cleanup failed: %v", err)
-	}
+// pullRequest is the JSON body of a pull. FooterHash is optional; it's the
+// hash (see FooterHash) of the bundle footer the client already has. Scale
+// comes from the "scale" parameter instead, and is zero if the client
+// wants every density of its images.
+type pullRequest struct {
+	AssetHashes map[string]string `json:"asset_hashes"`
+	FooterHash  string            `json:"footer_hash"`
+	Scale       float64           `json:"-"`
 }
 
-func parseAssetHashes(r *http.Request) (assetHashes map[string]string,
-	err error) {
+func parsePullRequest(r *http.Request) (req *pullRequest, err error) {
 	b, err := ioutil.ReadAll(r.Body)
-	var obj struct {
-		AssetHashes map[string]string `json:"asset_hashes"`
-	}
+	var obj pullRequest
 	if err := json.Unmarshal(b, &obj); err != nil {
 		return nil, err
 	} else if obj.AssetHashes == nil {
 		return nil, fmt.Errorf("Empty struct found for AssetHashes.")
 	}
-	return obj.AssetHashes, nil
+	return &obj, nil
 }
 
 // Pull handles a response for the /pull route
 func Pull(w http.ResponseWriter, r *http.Request) {
-	assetHashes, err := parseAssetHashes(r)
+	req, err := parsePullRequest(r)
 	if err != nil {
 		log.Printf("Error decoding /pull JSON: %v", err)
 		http.Error(w, "Malformed payload.", 500)
@@ -202,18 +311,50 @@ func Pull(w http.ResponseWriter, r *http.Request) {
 	}
 
 	appID := context.Get(r, AppIDKey).(string)
-	platform := r.FormValue("platform")
-	if platform == "" {
-		platform = "ios"
+	platform, err := RequestedPlatform(r.FormValue("platform"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if scale := r.FormValue("scale"); scale != "" {
+		req.Scale, err = strconv.ParseFloat(scale, 64)
+		if err != nil || req.Scale <= 0 {
+			http.Error(w, "Invalid scale.", http.StatusBadRequest)
+			return
+		}
 	}
 
 	archive, err := newPullArchive(appID, submissionID)
-	defer archive.close()
+	if err != nil {
+		log.Printf("newPullArchive() error: %v", err)
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+
+	// In manifest mode the client fetches each file itself (see
+	// writeManifest), so there's no zip to cache.
+	manifest := r.FormValue("mode") == "manifest"
 
 	// Open up a postgres connection
 	db := OpenDB()
 	defer db.Close()
 
+	// Serve the response from the cache if we've built it before. Failing
+	// to work out the key just means we don't cache this one.
+	cacheKey := ""
+	if !manifest {
+		cacheKey, err = PullCacheKey(archive.cache, platform.Name, req)
+		if err != nil {
+			log.Printf("(Ignored) PullCacheKey() error: %v", err)
+			cacheKey = ""
+		} else if b := GetCachedPull(db, archive.cache, cacheKey); b != nil {
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("X-Siphon-Pull-Cache", "hit")
+			w.Write(b)
+			return
+		}
+	}
+
 	// Make sure this app has files, i.e. it has been pushed
 	if err := archive.assertNotEmpty(db); err != nil {
 		if err == errAppEmpty {
@@ -227,38 +368,45 @@ func Pull(w http.ResponseWriter, r *http.Request) {
 
 	// Grab our currently stored asset names (also, it's an error to pull
 	// an app if no files have been pushed yet).
-	if err := archive.getAssetFiles(db); err != nil {
+	archive.loadAssetExtensions(db)
+	if err := archive.getAssetFiles(db, platform.Name); err != nil {
 		// Otherwise it's some unexpected error
 		log.Printf("getAssetFiles() error: %v", err)
 		http.Error(w, "Internal error.", 500)
 		return
 	}
-
-	// Write the assets listing file
-	if err = archive.writeAssetsListing(); err != nil {
-		log.Printf("WriteAssetsListing() error: %v", err)
-		http.Error(w, "Internal error.", 500)
-		return
+	archive.compareAssets(req.AssetHashes)
+	if req.Scale > 0 {
+		archive.selectDensities(req.Scale)
 	}
 
-	// Write the differing assets
-	if err = archive.writeAssets(assetHashes); err != nil {
-		log.Printf("WriteAssets() error: %v", err)
+	// Fetch the bundle footer
+	if err = archive.loadBundleFooter(platform, req.FooterHash); err != nil {
+		log.Printf("loadBundleFooter() error: %v", err)
 		http.Error(w, "Internal error.", 500)
 		return
 	}
 
-	// Write the bundle footer
-	if err = archive.writeBundleFooter(platform); err != nil {
-		log.Printf("WriteBundleFooter() error: %v", err)
-		http.Error(w, "Internal error.", 500)
+	if manifest {
+		archive.writeManifest(w, r)
 		return
 	}
 
-	// Write the response back to the client
-	if err = archive.writeZip(w); err != nil {
-		log.Printf("WriteZip() error: %v", err)
-		http.Error(w, "Internal error.", 500)
+	// Stream the response back to the client. Once we've started writing
+	// the zip we can't send an error response, so the best we can do is
+	// log it and stop (the client will see a truncated zip).
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("X-Siphon-Pull-Cache", "miss")
+	recorder := &pullRecorder{}
+	err = archive.writeZip(io.MultiWriter(w, recorder), r.Context().Done())
+	if err != nil {
+		log.Printf("writeZip() error: %v", err)
 		return
 	}
+	if cacheKey != "" && !recorder.tooLarge {
+		if err := SetCachedPull(db, archive.cache, cacheKey,
+			recorder.buf.Bytes()); err != nil {
+			log.Printf("(Ignored) SetCachedPull() error: %v", err)
+		}
+	}
 }
@@ -0,0 +1,139 @@
+package bundler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Pull responses are cached under the app's current "pull generation". A
+// push or submit starts a new generation, so a stale archive can never be
+// served even if cleaning up the old ones fails. The responses are kept in
+// S3 only (they're usually too big for memcache) and indexed in postgres,
+// which is what expires them and finds them to clean up.
+const pullGenerationKey = "pull-generation"
+
+// Archives bigger than this aren't worth caching
+const pullCacheMaxSize = 20 * 1024 * 1024
+
+// How long a cached response is served for, at most
+const pullCacheTTL = 24 * time.Hour
+
+// pullGeneration returns the current generation, starting one if needed.
+func pullGeneration(cache *Cache) (string, error) {
+	b, err := cache.Get(pullGenerationKey)
+	if err == nil && len(b) > 0 {
+		return string(b), nil
+	}
+	gen := randomID()
+	if err := cache.Set(pullGenerationKey, []byte(gen)); err != nil {
+		return "", err
+	}
+	return gen, nil
+}
+
+// PullCacheKey returns the key a pull response is cached under, which
+// depends on everything in the request that changes the response.
+func PullCacheKey(cache *Cache, platform string, req *pullRequest) (string,
+	error) {
+	gen, err := pullGeneration(cache)
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for name := range req.AssetHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s\n", name, req.AssetHashes[name])
+	}
+	fmt.Fprintf(h, "footer\x00%s\n", req.FooterHash)
+	fmt.Fprintf(h, "scale\x00%g\n", req.Scale)
+	digest := hex.EncodeToString(h.Sum(nil))
+	return fmt.Sprintf("pull-cache/%s/%s/%s", gen, platform, digest), nil
+}
+
+// GetCachedPull returns a cached pull response, or nil if there isn't one.
+func GetCachedPull(db *sql.DB, cache *Cache, key string) []byte {
+	ok, err := HasPullCacheEntry(db, cache.appID, cache.submissionID, key,
+		pullCacheTTL)
+	if err != nil || !ok {
+		return nil
+	}
+	b, err := cache.GetStored(key)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// SetCachedPull caches a pull response and records its key in the index,
+// then cleans up any of the app's responses that have expired.
+func SetCachedPull(db *sql.DB, cache *Cache, key string, b []byte) error {
+	if err := cache.SetStored(key, b); err != nil {
+		return err
+	}
+	err := AddPullCacheEntry(db, cache.appID, cache.submissionID, key)
+	if err != nil {
+		// Don't leave behind a response that nothing will clean up
+		if err := cache.Delete(key); err != nil {
+			log.Printf("(Ignored) SetCachedPull() delete error: %v", err)
+		}
+		return err
+	}
+	removeCachedPulls(db, cache, pullCacheTTL)
+	return nil
+}
+
+// InvalidatePullCache starts a new pull generation, then removes the
+// responses cached in previous ones.
+func InvalidatePullCache(db *sql.DB, cache *Cache) error {
+	if err := cache.Set(pullGenerationKey, []byte(randomID())); err != nil {
+		return err
+	}
+	removeCachedPulls(db, cache, 0)
+	return nil
+}
+
+// removeCachedPulls deletes the cached responses older than `maxAge` (or
+// all of them, if it's zero). Each index row is only handed to one caller,
+// so concurrent clean ups don't trip over each other.
+func removeCachedPulls(db *sql.DB, cache *Cache, maxAge time.Duration) {
+	keys, err := DeletePullCacheEntries(db, cache.appID, cache.submissionID,
+		maxAge)
+	if err != nil {
+		log.Printf("(Ignored) removeCachedPulls() error: %v", err)
+		return
+	}
+	for _, key := range keys {
+		if err := cache.Delete(key); err != nil {
+			log.Printf("(Ignored) removeCachedPulls() delete error: %v", err)
+		}
+	}
+}
+
+// pullRecorder keeps a copy of a pull response as it's streamed, giving up
+// once it gets too big to be worth caching.
+type pullRecorder struct {
+	buf      bytes.Buffer
+	tooLarge bool
+}
+
+func (p *pullRecorder) Write(b []byte) (int, error) {
+	if !p.tooLarge {
+		if p.buf.Len()+len(b) > pullCacheMaxSize {
+			p.tooLarge = true
+			p.buf.Reset()
+		} else {
+			p.buf.Write(b)
+		}
+	}
+	return len(b), nil
+}
@@ -10,14 +10,22 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/context"
 )
 
 // HashesResponse represents an app's files (names mapped to SHA-256 hashes).
+// If `Since` is set, this is an incremental listing: `Files` only holds the
+// files added or changed since that revision and `Removed` lists the rest.
 type HashesResponse struct {
-	Files map[string]string `json:"hashes"`
+	Files    map[string]string `json:"hashes"`
+	Revision string            `json:"revision"` // see RevisionToken()
+	Since    string            `json:"since,omitempty"`
+	Removed  []string          `json:"removed,omitempty"`
 }
 
 // MakeJSONHashes returns the JSON bytes representation of the current
@@ -30,13 +38,37 @@ func MakeJSONHashes(appID string) (HashesResponse, error) {
 	if err != nil {
 		return HashesResponse{}, err
 	}
-	obj := HashesResponse{files}
+	obj := HashesResponse{Files: files, Revision: RevisionToken(files)}
 	return obj, nil
 }
 
+// makeIncremental reduces `resp` to the changes since the revision `since`.
+// It leaves `resp` alone if we have no record of that revision, in which
+// case the client gets the full listing.
+func makeIncremental(db *sql.DB, appID string, resp *HashesResponse,
+	since string) error {
+	previous, err := GetRevision(db, appID, since)
+	if err != nil || previous == nil {
+		return err
+	}
+	diff := DiffFiles(previous, resp.Files)
+	files := map[string]string{}
+	for _, name := range append(diff.Added, diff.Changed...) {
+		files[name] = resp.Files[name]
+	}
+	resp.Files = files
+	resp.Since = since
+	resp.Removed = diff.Removed
+	return nil
+}
+
 // Writes a JSON response containing the SHA-256 hashes that we
-// currently have stored for the specified app.
-func writeHashesResponse(w http.ResponseWriter, appID string) {
+// currently have stored for the specified app. The revision token is also
+// sent as an ETag, which the client should send back when it pushes. We
+// respond with a 304 if the client's If-None-Match is current, and only
+// send the changes if it passed a "since" revision.
+func writeHashesResponse(w http.ResponseWriter, r *http.Request,
+	appID string) {
 	w.Header().Set("Content-Type", "application/json")
 	hashesResponse, err := MakeJSONHashes(appID)
 	if err != nil {
@@ -44,6 +76,22 @@ func writeHashesResponse(w http.ResponseWriter, appID string) {
 		http.Error(w, "Internal error.", 500)
 		return
 	}
+	w.Header().Set("ETag", FormatETag(hashesResponse.Revision))
+	if ETagMatches(r.Header.Get("If-None-Match"), hashesResponse.Revision) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if since := r.FormValue("since"); since != "" {
+		db := OpenDB()
+		defer db.Close()
+		err = makeIncremental(db, appID, &hashesResponse, since)
+		if err != nil {
+			log.Printf("Failed to make incremental hashes: %v", err)
+			http.Error(w, "Internal error.", 500)
+			return
+		}
+	}
 	b, err := json.Marshal(hashesResponse)
 	if err != nil {
 		log.Printf("Failed to serialize hashes: %v", err)
@@ -70,17 +118,22 @@ type pushHandler struct {
 	request  *http.Request
 	response http.ResponseWriter
 
-	appID   string
-	userID  string
-	db      *sql.DB
-	cache   *Cache
-	archive *Archive
-	dirty   bool // signals that we need to generate a new bundle footer
+	appID    string
+	userID   string
+	db       *sql.DB
+	cache    *Cache
+	archive  *Archive
+	progress *Progress
+	dirty    bool // signals that we need to generate a new bundle footer
+	dryRun   bool // report what would change, but don't write anything
 
 	// Metadata (i.e. contents of Siphonfile)
 	metadata      *Metadata
 	icons         []*IconData
 	metadataDirty bool // true indicates that a PUT needs to happen
+
+	ignore *IgnoreRules    // defaults plus the app's .siphonignore
+	shared map[string]bool // hashes only stored by other apps (see dedup)
 }
 
 func newPushHandler(w http.ResponseWriter, r *http.Request,
@@ -96,6 +149,7 @@ func newPushHandler(w http.ResponseWriter, r *http.Request,
 		appID:         appID,
 		userID:        userID,
 		cache:         cache,
+		progress:      NewProgress(w, r),
 		dirty:         false,
 		metadataDirty: false,
 	}, nil
@@ -103,7 +157,7 @@ func newPushHandler(w http.ResponseWriter, r *http.Request,
 
 func (h *pushHandler) remove(names []string) error {
 	for _, name := range names {
-		h.log("--> " + name) // log progress to the user
+		h.progress.File("remove", name) // log progress to the user
 		// We need the current hash we have stored for this file
 		files, _ := GetFiles(h.db, h.appID, "")
 		hash, ok := files[name]
@@ -128,21 +182,33 @@ func (h *pushHandler) remove(names []string) error {
 
 // If add == false, then we will UPDATE the file row, not INSERT a new one.
 func (h *pushHandler) update(names []string, add bool) error {
+	action := "update"
+	if add {
+		action = "add"
+	}
 	for _, name := range names {
-		h.log("--> " + name) // log progress to the user
-		// Retrieve the file content from the archive for this name
+		h.progress.File(action, name) // log progress to the user
 		hash := h.archive.GetHash(name)
-		b, err := h.archive.GetContent(name)
 		if hash == "" {
 			return fmt.Errorf("Hash not found for name: %s", name)
-		} else if err != nil {
-			return fmt.Errorf("Get content for hash %s failed: %v", hash, err)
 		}
-		// Write the file to S3 and memcache
-		if err := h.cache.Set(hash, b); err != nil {
-			return err
+		// If the client omitted the content, it's because we already store
+		// a blob with this hash (Archive.Compare() checked), or because
+		// another app does and copySharedBlobs() has already copied it.
+		if h.archive.HasContent(name) {
+			// Retrieve the file content from the archive for this name
+			b, err := h.archive.GetContent(name)
+			if err != nil {
+				return fmt.Errorf("Get content for hash %s failed: %v", hash,
+					err)
+			}
+			// Write the file to S3 and memcache
+			if err := h.cache.Set(hash, b); err != nil {
+				return err
+			}
 		}
 		// Add or update the file row in our local database
+		var err error
 		if add {
 			err = AddFile(h.db, h.appID, "", name, hash)
 		} else {
@@ -156,15 +222,11 @@ func (h *pushHandler) update(names []string, add bool) error {
 	return nil
 }
 
-func (h *pushHandler) log(s string) {
-	BufferLine(h.response, s)
-}
-
-func (h *pushHandler) decompress(r *http.Request) error {
-	b, err := ioutil.ReadAll(r.Body) // we must read before we write
-	h.log("Decompressing...")
+func (h *pushHandler) decompress(b []byte, contentType string) error {
+	h.progress.Phase("decompress", "Decompressing...")
 	archive := NewArchive()
-	err = archive.Decompress(b)
+	err := archive.Decompress(b, PayloadFormat(contentType),
+		NewExtractPolicy())
 	if err != nil {
 		archive.Close()
 		return err
@@ -177,13 +239,13 @@ func (h *pushHandler) decompress(r *http.Request) error {
 // instead we show 'Internal error' to them.
 func (h *pushHandler) internalError(err error, debug string) {
 	log.Printf("[pushHandler() error] %s: %v [type=%T]", debug, err, err)
-	http.Error(h.response, "Internal error.", 500)
+	h.progress.InternalError()
 }
 
 // For when the error message is appropriate to show to the user.
 func (h *pushHandler) expectedError(err error) {
 	log.Printf("[pushHandler() user-facing error] %v [type=%T]", err, err)
-	http.Error(h.response, "[ERROR] "+err.Error(), 500)
+	h.progress.Fail(err.Error())
 }
 
 // putMetadata initiates the PUT request to Django to change
@@ -197,10 +259,11 @@ func (h *pushHandler) putMetadata() error {
 	v.Set("base_version", h.metadata.BaseVersion)
 	v.Set("display_name", h.metadata.DisplayName)
 	v.Set("facebook_app_id", h.metadata.FacebookAppID)
-	v.Set("app_store_name", h.metadata.IOS.StoreName)
-	v.Set("play_store_name", h.metadata.Android.StoreName)
-	v.Set("app_store_language", h.metadata.IOS.Language)
-	v.Set("play_store_language", h.metadata.Android.Language)
+	for _, p := range Platforms() {
+		section := h.metadata.Section(p.Name)
+		v.Set(p.StoreNameField, section.StoreName)
+		v.Set(p.StoreLanguageField, section.Language)
+	}
 
 	iconsList, err := json.Marshal(h.icons)
 	if err != nil {
@@ -251,7 +314,7 @@ func (h *pushHandler) putMetadata() error {
 }
 
 func (h *pushHandler) loadMetaData() error {
-	h.log("Checking your Siphonfile...")
+	h.progress.Phase("metadata", "Checking your Siphonfile...")
 	// First try to load it from the archive (it's only present if it changed)
 	b, err := h.archive.GetMetadata()
 	if err != nil {
@@ -271,7 +334,14 @@ func (h *pushHandler) loadMetaData() error {
 			log.Printf("[GetFile() metadata error] %v", err)
 			return errors.New("Problem loading Siphonfile from the cache.")
 		}
-		res, err := h.cache.Get(hash)
+		// The client may have omitted a changed Siphonfile if we already
+		// have a file with the same content, so prefer the listing's hash.
+		if listed := h.archive.GetHash(MetadataName); listed != "" &&
+			listed != hash {
+			hash = listed
+			h.metadataDirty = true
+		}
+		res, err := h.getBlob(hash)
 		if err != nil {
 			log.Printf("[Cache.Get() metadata error] %v, hash=%s", err, hash)
 			return errors.New("Problem loading Siphonfile from the cache.")
@@ -288,16 +358,267 @@ func (h *pushHandler) loadMetaData() error {
 	return nil
 }
 
+// logFiles reports each name in `names` as a processed file and records
+// it against the push result.
+func (h *pushHandler) logFiles(action string, names []string,
+	result *[]string) {
+	for _, name := range names {
+		h.progress.File(action, name)
+	}
+	*result = append(*result, names...)
+}
+
+// handleDryRun runs the same checks as handle() against the decompressed
+// archive, but only reports what would change. Nothing is written to S3,
+// postgres, Django or RabbitMQ.
+func (h *pushHandler) handleDryRun() {
+	// Load and check the Siphonfile metadata from the archive or cache
+	if err := h.loadMetaData(); err != nil {
+		h.progress.Error(err.Error())
+	}
+
+	// Compare the archive's listing to our current hashes for this app
+	files, err := GetFiles(h.db, h.appID, "")
+	if err != nil {
+		h.internalError(err, "GetFiles()")
+		return
+	}
+	comp, err := h.archive.Compare(files, h.ignore, h.shared)
+	if err != nil {
+		h.internalError(err, "archive.Compare()")
+		return
+	}
+	result := &h.progress.result
+	h.progress.Phase("compare", "Comparing files...")
+	h.logFiles("ignore", comp.ignored, &result.Ignored)
+	h.logFiles("add", comp.added, &result.Added)
+	h.logFiles("update", comp.changed, &result.Changed)
+	h.logFiles("remove", comp.removed, &result.Removed)
+	if len(comp.added)+len(comp.changed)+len(comp.removed) == 0 {
+		h.progress.Note("No changes detected.")
+	}
+
+	// The archive's listing is what the app would look like after this
+	// push, but we only need to copy the icons to validate them.
+	icons := map[string]string{}
+	for name, hash := range h.archive.listing {
+		if strings.HasPrefix(name, "publish/") && !h.ignore.Ignored(name) {
+			icons[name] = hash
+		}
+	}
+	// A dry run doesn't copy shared blobs into this app's cache, so any
+	// icons that only another app stores are read from that app instead.
+	own, shared := map[string]string{}, map[string]string{}
+	for name, hash := range icons {
+		if !h.archive.HasContent(name) && h.shared[hash] {
+			shared[name] = hash
+		} else {
+			own[name] = hash
+		}
+	}
+	d, err := FilesToTemp(own, h.db, h.archive, h.cache)
+	if err != nil {
+		h.internalError(err, "FilesToTemp()")
+		return
+	}
+	defer Cleanup(d)
+	for name, hash := range shared {
+		b, err := sharedBlob(h.db, hash)
+		if err == nil {
+			p := path.Join(d, name)
+			os.MkdirAll(filepath.Dir(p), 0700)
+			err = ioutil.WriteFile(p, b, 0700)
+		}
+		if err != nil {
+			h.internalError(err, "sharedBlob()")
+			return
+		}
+	}
+	if _, err := GetIcons(d, icons); err != nil {
+		h.progress.Error(err.Error())
+	}
+
+	if len(result.Errors) == 0 {
+		h.progress.Done("Dry run passed, no changes were made.")
+	} else {
+		h.progress.Done("Dry run failed, no changes were made.")
+	}
+}
+
+// checkRevision rejects the push with a conflict if the client based it on
+// a revision other than the app's current one, and returns false if so.
+// Clients that don't send a revision are let through as before.
+func (h *pushHandler) checkRevision() bool {
+	token := RequestedRevision(h.request)
+	if token == "" {
+		return true
+	}
+	files, err := GetFiles(h.db, h.appID, "")
+	if err != nil {
+		h.internalError(err, "GetFiles()")
+		return false
+	}
+	if RevisionToken(files) == token {
+		return true
+	}
+	previous, err := GetRevision(h.db, h.appID, token)
+	if err != nil {
+		h.internalError(err, "GetRevision()")
+		return false
+	}
+	var diff *RevisionDiff
+	if previous != nil {
+		diff = DiffFiles(previous, files)
+	}
+	log.Printf("[pushHandler() conflict] app=%s, revision=%s", h.appID, token)
+	h.progress.Conflict("This app has been pushed to since you fetched its "+
+		"hashes. Please try again.", diff)
+	return false
+}
+
+// loadIgnoreRules combines the default ignore patterns with the app's
+// .siphonignore, which is taken from the archive if it changed or from the
+// cache if it didn't.
+func (h *pushHandler) loadIgnoreRules() error {
+	b, err := h.archive.GetIgnoreFile()
+	if err != nil {
+		log.Printf("[Archive.GetIgnoreFile() error] %v", err)
+		return fmt.Errorf("Problem loading %s from the archive.",
+			IgnoreFileName)
+	}
+	if b == nil {
+		if hash := h.archive.GetHash(IgnoreFileName); hash != "" {
+			b, err = h.getBlob(hash)
+			if err != nil {
+				log.Printf("[Cache.Get() ignore file error] %v, hash=%s", err,
+					hash)
+				return fmt.Errorf("Problem loading %s from the cache.",
+					IgnoreFileName)
+			}
+		}
+	}
+	h.ignore = NewIgnoreRules(b)
+	return nil
+}
+
+// loadSharedHashes finds the listing's hashes that only other apps store,
+// so their content can be omitted when dedup is enabled.
+func (h *pushHandler) loadSharedHashes() error {
+	hashes, err := h.archive.ListingHashes()
+	if err != nil {
+		return err
+	}
+	h.shared, err = sharedHashes(h.db, h.appID, hashes)
+	return err
+}
+
+// getBlob returns the content of a blob the client omitted, reading it from
+// another app if only that app stores it (see copySharedBlobs()).
+func (h *pushHandler) getBlob(hash string) ([]byte, error) {
+	if h.shared[hash] {
+		return sharedBlob(h.db, hash)
+	}
+	return h.cache.Get(hash)
+}
+
+// copySharedBlobs copies the blobs that the client omitted because another
+// app stores them into this app's cache, so that everything after this
+// (the Siphonfile, icons, the footer build) can read them from there.
+// Ignored files are never stored, so they're skipped.
+func (h *pushHandler) copySharedBlobs() error {
+	copied := map[string]bool{}
+	for name, hash := range h.archive.listing {
+		if !h.shared[hash] || copied[hash] || h.archive.HasContent(name) ||
+			h.ignore.Ignored(name) {
+			continue
+		}
+		if err := copySharedBlob(h.db, h.cache, hash); err != nil {
+			return err
+		}
+		copied[hash] = true
+	}
+	return nil
+}
+
+// audit records the outcome of this push in the audit log.
+func (h *pushHandler) audit() {
+	result := &h.progress.result
+	e := &AuditEntry{Action: AuditPush, AppID: h.appID,
+		Outcome: AuditSuccess, Files: AuditFiles{Added: result.Added,
+			Changed: result.Changed, Removed: result.Removed}}
+	if !result.Success {
+		e.Outcome = AuditFailure
+		e.Message = strings.Join(result.Errors, "\n")
+	}
+	RecordAudit(h.request, e)
+}
+
 func (h *pushHandler) handle(r *http.Request) {
+	// Dry runs don't change anything, so they aren't audited
+	if !h.dryRun {
+		defer h.audit()
+	}
+
+	b, err := ioutil.ReadAll(r.Body) // we must read before we write
+	if err != nil {
+		h.internalError(err, "ReadAll()")
+		return
+	}
+
+	// Wait for any other push or submit for this app to finish (a dry run
+	// doesn't write anything, so it doesn't need to wait).
+	if !h.dryRun {
+		lock, err := LockApp(h.db, h.appID, func() {
+			h.progress.Phase("queued",
+				"Waiting for another push to this app to finish...")
+		})
+		if err == errAppLockTimeout {
+			h.expectedError(err)
+			return
+		} else if err != nil {
+			h.internalError(err, "LockApp()")
+			return
+		}
+		defer lock.Release()
+	}
+
+	// Make sure nobody else has pushed since the client fetched its hashes
+	if !h.checkRevision() {
+		return
+	}
+
 	// Decompress the payload
-	if err := h.decompress(r); err != nil {
+	err = h.decompress(b, r.Header.Get("Content-Type"))
+	if _, ok := err.(*ExtractError); ok {
+		h.expectedError(err)
+		return
+	} else if err != nil {
 		h.internalError(err, "decompress()")
 		return
 	}
 	defer h.archive.Close() // clean up the archive's temporary directory
 
+	// The shared hashes come first, because the .siphonignore may be one
+	if err := h.loadSharedHashes(); err != nil {
+		h.internalError(err, "loadSharedHashes()")
+		return
+	}
+	if err := h.loadIgnoreRules(); err != nil {
+		h.expectedError(err)
+		return
+	}
+
+	if h.dryRun {
+		h.handleDryRun()
+		return
+	}
+	if err := h.copySharedBlobs(); err != nil {
+		h.internalError(err, "copySharedBlobs()")
+		return
+	}
+
 	// Load and check the Siphonfile metadata from the archive or cache
-	err := h.loadMetaData()
+	err = h.loadMetaData()
 	if err != nil {
 		h.expectedError(err)
 		return
@@ -305,15 +626,25 @@ func (h *pushHandler) handle(r *http.Request) {
 
 	// Compare the archive's listing to our current hashes for this app
 	files, _ := GetFiles(h.db, h.appID, "")
-	comp, err := h.archive.Compare(files)
+	comp, err := h.archive.Compare(files, h.ignore, h.shared)
 	if err != nil {
 		h.internalError(err, "archive.Compare()")
 		return
 	}
 
+	// Let the user know about anything we skipped
+	result := &h.progress.result
+	if len(comp.ignored) > 0 {
+		h.progress.Phase("ignore", "Ignoring files...")
+		h.logFiles("ignore", comp.ignored, &result.Ignored)
+	}
+	result.Added = append(result.Added, comp.added...)
+	result.Changed = append(result.Changed, comp.changed...)
+	result.Removed = append(result.Removed, comp.removed...)
+
 	// Process additions
 	if len(comp.added) > 0 {
-		h.log("Adding files...")
+		h.progress.Phase("add", "Adding files...")
 		if err := h.update(comp.added, true); err != nil {
 			h.internalError(err, "update() add=true")
 			return
@@ -322,7 +653,7 @@ func (h *pushHandler) handle(r *http.Request) {
 
 	// Process changes
 	if len(comp.changed) > 0 {
-		h.log("Updating files...")
+		h.progress.Phase("update", "Updating files...")
 		if err := h.update(comp.changed, false); err != nil {
 			h.internalError(err, "update() add=false")
 			return
@@ -331,7 +662,7 @@ func (h *pushHandler) handle(r *http.Request) {
 
 	// Process removals
 	if len(comp.removed) > 0 {
-		h.log("Removing deleted files...")
+		h.progress.Phase("remove", "Removing deleted files...")
 		if err := h.remove(comp.removed); err != nil {
 			h.internalError(err, "remove()")
 			return
@@ -347,7 +678,8 @@ func (h *pushHandler) handle(r *http.Request) {
 	}
 
 	if !h.dirty && !h.metadataDirty {
-		h.log("No changes detected.")
+		result.Revision = RevisionToken(files)
+		h.progress.Done("No changes detected.")
 		return
 	}
 
@@ -367,13 +699,26 @@ func (h *pushHandler) handle(r *http.Request) {
 
 	h.icons = icons
 
+	// Warn about platform-specific files that a declared platform has no
+	// version of, since that platform's build won't find them.
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	for _, msg := range PlatformWarnings(names,
+		h.metadata.DeclaredPlatforms()) {
+		h.progress.Warning(msg)
+	}
+
 	// Generate new bundle footers if we got this far
-	h.log("Building diffs...")
-	f, err := MakeBundleFooters(d, h.metadata.BaseVersion)
+	h.progress.Phase("footer", "Building diffs...")
+	f, err := MakePlatformFooters(d, files, h.metadata)
 	if err != nil {
 		// Clean up our temp dir
 		Cleanup(d)
 		h.expectedError(err)
+		PostWebhookEvent(h.appID, WebhookEventBuildFailed, h.userID, "",
+			&WebhookBuildFailure{Stage: "push", Error: err.Error()})
 		return
 	}
 	Cleanup(d)
@@ -402,39 +747,44 @@ func (h *pushHandler) handle(r *http.Request) {
 
 	// Write the footers to S3 (and memcache) and clean up the footers if we
 	// encounter any errors
-	if f.IOS != "" {
-		ftr, err := ioutil.ReadFile(f.IOS)
+	for _, p := range Platforms() {
+		if f[p.Name] == "" {
+			continue
+		}
+		ftr, err := ioutil.ReadFile(f[p.Name])
 		if err != nil {
 			h.internalError(err, "ReadFile()")
 			CleanupFooters(f)
 			return
 		}
-		if err := h.cache.SetBundleFooter(ftr, BundleFooterFile("ios")); err != nil {
+		if err := h.cache.SetBundleFooter(ftr, p.FooterKey()); err != nil {
 			h.internalError(err, "SetBundleFooter()")
 			CleanupFooters(f)
 			return
 		}
 	}
 
-	if f.Android != "" {
-		ftr, err := ioutil.ReadFile(f.Android)
-		if err != nil {
-			h.internalError(err, "ReadFile()")
-			CleanupFooters(f)
-			return
-		}
-		if err := h.cache.SetBundleFooter(ftr, BundleFooterFile("android")); err != nil {
-			h.internalError(err, "SetBundleFooter()")
-			CleanupFooters(f)
-			return
-		}
+	// Record the new state of the app, so that the client can base its
+	// next push on it.
+	token, err := RecordRevision(h.db, h.appID, h.userID, files)
+	if err != nil {
+		h.internalError(err, "RecordRevision()")
+		CleanupFooters(f)
+		return
+	}
+	result.Revision = token
+
+	// Any pull responses we've cached are now out of date
+	if err := InvalidatePullCache(h.db, h.cache); err != nil {
+		log.Printf("(Ignored) InvalidatePullCache() error: %v", err)
 	}
-	h.log("Done.")
+	h.progress.Done("Done.")
 
 	CleanupFooters(f)
 
-	// Post an app update notification (fails silently)
+	// Post an app update notification and webhooks (fail silently)
 	PostAppUpdated(h.appID, h.userID)
+	PostWebhookEvent(h.appID, WebhookEventPush, h.userID, "", result)
 }
 
 // Push handles a response for the /push route
@@ -445,7 +795,7 @@ func Push(w http.ResponseWriter, r *http.Request) {
 	userID := context.Get(r, UserIDKey).(string)
 
 	if r.Method == "GET" {
-		writeHashesResponse(w, appID)
+		writeHashesResponse(w, r, appID)
 	} else if r.Method == "POST" {
 		// defer to pushHandler() to service this request
 		h, err := newPushHandler(w, r, appID, userID)
@@ -456,6 +806,8 @@ func Push(w http.ResponseWriter, r *http.Request) {
 		db := OpenDB() // we create/assign like this so we can use defer
 		defer db.Close()
 		h.db = db
+		h.dryRun, _ = strconv.ParseBool(r.FormValue("dry_run"))
+		h.progress.result.DryRun = h.dryRun
 		h.handle(r)
 	} else {
 		http.Error(w, "Expected GET or POST.", 500)
@@ -0,0 +1,134 @@
+package bundler
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RevisionToken returns a token identifying the given state of an app's files
+// (name -> SHA-256 hash). Identical listings always produce the same token,
+// so it doubles as the ETag for GET /v1/push/.
+func RevisionToken(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s\n", name, files[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RevisionDiff lists the names that differ between two states of an app.
+type RevisionDiff struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// DiffFiles returns the changes needed to get from `from` to `to`.
+func DiffFiles(from map[string]string, to map[string]string) *RevisionDiff {
+	diff := &RevisionDiff{Added: []string{}, Changed: []string{},
+		Removed: []string{}}
+	for name, hash := range to {
+		fromHash, ok := from[name]
+		if !ok {
+			diff.Added = append(diff.Added, name)
+		} else if fromHash != hash {
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range from {
+		if _, ok := to[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+// String formats the diff as indented lines for a text response.
+func (d *RevisionDiff) String() string {
+	lines := []string{}
+	for _, name := range d.Added {
+		lines = append(lines, "  added:   "+name)
+	}
+	for _, name := range d.Changed {
+		lines = append(lines, "  changed: "+name)
+	}
+	for _, name := range d.Removed {
+		lines = append(lines, "  removed: "+name)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// FormatETag quotes a revision token for use in an ETag header.
+func FormatETag(token string) string {
+	return `"` + token + `"`
+}
+
+// parseETag strips the quotes (and weak prefix) from an ETag value.
+func parseETag(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "W/")
+	return strings.Trim(s, `"`)
+}
+
+// ETagMatches returns true if an If-None-Match style `header` (a list of
+// ETags, or "*") includes the given revision token.
+func ETagMatches(header string, token string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, etag := range strings.Split(header, ",") {
+		if etag != "" && parseETag(etag) == token {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestedRevision returns the revision token a client based its request
+// on, taken from the If-Match header or the "revision" parameter. It
+// returns "" if the client did not send one.
+func RequestedRevision(r *http.Request) string {
+	if v := r.Header.Get("If-Match"); v != "" && v != "*" {
+		return parseETag(v)
+	}
+	return r.FormValue("revision")
+}
+
+// How many revisions of each app we keep a record of. Older ones are pruned
+// as new ones are recorded, after which pushes and incremental GETs based on
+// them just get less detail (see checkRevision and makeIncremental).
+const revisionHistoryLength = 100
+
+// RecordRevision saves `files` as a revision of the app unless we already
+// have a record of that exact state, and returns its token.
+func RecordRevision(db *sql.DB, appID string, userID string,
+	files map[string]string) (token string, err error) {
+	token = RevisionToken(files)
+	existing, err := GetRevision(db, appID, token)
+	if err != nil {
+		return "", err
+	} else if existing != nil {
+		return token, nil
+	}
+	if _, err := AddRevision(db, appID, userID, files); err != nil {
+		return "", err
+	}
+	if err := PruneRevisions(db, appID, revisionHistoryLength); err != nil {
+		log.Printf("(Ignored) PruneRevisions() error: %v", err)
+	}
+	return token, nil
+}
@@ -13,10 +13,34 @@ func initRouter() *mux.Router {
 	router := mux.NewRouter()
 	router.Handle("/v1/push/{app_id}/",
 		gziphandler.GzipHandler(AuthMiddleware(Push))).Methods("GET", "POST")
+	router.Handle("/v1/push/{app_id}/missing/",
+		gziphandler.GzipHandler(AuthMiddleware(MissingBlobs))).Methods("POST")
 	router.Handle("/v1/pull/{app_id}/",
 		gziphandler.GzipHandler(AuthMiddleware(Pull))).Methods("POST")
+	router.Handle("/v1/files/{app_id}/",
+		gziphandler.GzipHandler(http.HandlerFunc(Files))).Methods("GET")
+	router.Handle("/v1/clone/{app_id}/",
+		gziphandler.GzipHandler(AuthMiddleware(Clone))).Methods("GET")
 	router.Handle("/v1/submit/{app_id}/",
 		gziphandler.GzipHandler(AuthMiddleware(Submit))).Methods("POST")
+	router.Handle("/v1/submit/{app_id}/jobs/{job_id}/",
+		gziphandler.GzipHandler(AuthMiddleware(SubmitJobStatus))).Methods(
+		"GET")
+	router.Handle("/v1/webhooks/{app_id}/",
+		gziphandler.GzipHandler(AuthMiddleware(Webhooks))).Methods("GET", "POST")
+	router.Handle("/v1/webhooks/{app_id}/{webhook_id}/",
+		gziphandler.GzipHandler(AuthMiddleware(DeleteWebhookHandler))).Methods(
+		"DELETE")
+	router.Handle("/v1/webhooks/{app_id}/{webhook_id}/deliveries/",
+		gziphandler.GzipHandler(AuthMiddleware(WebhookDeliveries))).Methods(
+		"GET")
+	router.Handle("/v1/webhooks/{app_id}/{webhook_id}/test/",
+		gziphandler.GzipHandler(AuthMiddleware(TestWebhook))).Methods("POST")
+	// Not gzipped, since the event stream needs to be flushed as it goes
+	router.Handle("/v1/events/{app_id}/",
+		AuthMiddleware(Events)).Methods("GET")
+	router.Handle("/v1/audit/{app_id}/",
+		gziphandler.GzipHandler(AuthMiddleware(AuditLog))).Methods("GET")
 	router.Handle("/v1/healthcheck/",
 		gziphandler.GzipHandler(Healthcheck())).Methods("GET")
 
@@ -25,10 +49,15 @@ func initRouter() *mux.Router {
 
 // Start is the entry point for a bundler server
 func Start() {
+	CheckFileURLSecret()
 	log.Print("Creating tables...")
 	CreateTables()
 	log.Print("Creating buckets...")
 	CreateBuckets()
+	log.Print("Starting submit workers...")
+	StartSubmitWorkers()
+	log.Print("Starting event listener...")
+	StartEventListener()
 	router := initRouter()
 
 	if os.Getenv("SIPHON_ENV") == "testing" {
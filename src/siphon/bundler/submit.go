@@ -2,28 +2,35 @@ package bundler
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"path"
+	"sort"
+	"strings"
 
 	"github.com/gorilla/context"
 )
 
 type submitHandler struct {
-	request      *http.Request
-	response     http.ResponseWriter
 	db           *sql.DB
 	appID        string
 	submissionID string
 	metadata     *Metadata
+	files        map[string]string // name -> hash, nil for the dev files
+	shared       map[string]bool   // hashes stored by other apps
 
 	devCache        *Cache
 	submissionCache *Cache
+
+	job     *SubmitJob // the job we report our progress against
+	failure string     // why the submit failed
 }
 
-func newSubmitHandler(w http.ResponseWriter, r *http.Request,
-	appID string, submissionID string) (
+func newSubmitHandler(appID string, submissionID string) (
 	h *submitHandler, err error) {
 
 	// We take advantage of the abstractions provided by our Cache class
@@ -35,8 +42,6 @@ func newSubmitHandler(w http.ResponseWriter, r *http.Request,
 		return nil, err
 	}
 	return &submitHandler{
-		request:         r,
-		response:        w,
 		appID:           appID,
 		submissionID:    submissionID,
 		devCache:        devCache,
@@ -44,67 +49,72 @@ func newSubmitHandler(w http.ResponseWriter, r *http.Request,
 	}, nil
 }
 
+// internalError logs the details of an error, but only tells the client
+// that something went wrong on our end.
 func (h *submitHandler) internalError(err error, debug string) {
 	log.Printf("[submitHandler() error] %s: %v [type=%T]", debug, err, err)
-	http.Error(h.response, "Internal error.", 500)
+	h.failure = "Internal error."
+}
+
+// expectedError fails the submit with a message meant for the client.
+func (h *submitHandler) expectedError(err error) {
+	log.Printf("[submitHandler() user-facing error] %v [type=%T]", err, err)
+	h.failure = err.Error()
+}
+
+// setProgress records how far through the submit we are.
+func (h *submitHandler) setProgress(percent int, stage string) {
+	if err := UpdateSubmitJob(h.db, h.job.ID, percent, stage); err != nil {
+		log.Printf("(Ignored) setProgress() error: %v", err)
+	}
 }
 
-// Generates new bundle footers and stores them against this submission ID in
-// S3. You should only call this after the files have been copied in S3.
-func (h *submitHandler) makeBundleFooter(platform string) error {
-	// Note that because the file rows have not be copied to the submission_id
-	// namespace in postgres yet, we need to run this against the app files,
-	// which is fine because they're identical.
-	f, err := MakeBundleFootersTmp(h.db, h.appID, "", nil, h.metadata.BaseVersion)
+// Generates new bundle footers for every platform the app is built for and
+// stores them against this submission ID in S3. You should only call this
+// after the files have been copied in S3.
+func (h *submitHandler) makeBundleFooters() error {
+	// Note that the file rows have not be copied to the submission_id
+	// namespace in postgres yet, so we pass the files in explicitly (their
+	// content has already been copied in S3).
+	f, err := MakeBundleFootersTmp(h.db, h.appID, h.submissionID, h.files,
+		nil, h.metadata)
 
 	if err != nil {
 		return err
 	}
 
-	// Write the footer to s3/cache and remove the temporary ones created
+	// Write the footers to s3/cache and remove the temporary ones created
 	// by the packager
-	if platform == "ios" && f.IOS != "" {
-		ftr, err := ioutil.ReadFile(f.IOS)
+	defer CleanupFooters(f)
+	for _, name := range h.metadata.DeclaredPlatforms() {
+		p, err := GetPlatform(name)
 		if err != nil {
-			CleanupFooters(f)
 			return err
 		}
-		if err := h.submissionCache.SetBundleFooter(ftr, BundleFooterFile(platform)); err != nil {
-			CleanupFooters(f)
-			return err
+		if f[p.Name] == "" {
+			return fmt.Errorf("Problem building footer for %s.", p.Title)
 		}
-
-	} else if platform == "android" && f.Android != "" {
-		ftr, err := ioutil.ReadFile(f.Android)
+		ftr, err := ioutil.ReadFile(f[p.Name])
 		if err != nil {
-			CleanupFooters(f)
 			return err
 		}
-		if err := h.submissionCache.SetBundleFooter(ftr, "bundle-footer"); err != nil {
-			CleanupFooters(f)
+		if err := h.submissionCache.SetBundleFooter(ftr,
+			p.FooterKey()); err != nil {
 			return err
 		}
-	} else {
-		CleanupFooters(f)
-		return errors.New("Problem building footer for platform.")
 	}
-
-	CleanupFooters(f)
 	return nil
 }
 
-// Retrieves the metadata (i.e. Siphonfile) stored for this app, because we
+// Retrieves the metadata (i.e. Siphonfile) being submitted, because we
 // need the "base_version" to generate a bundle footer. You must only call
 // this after the files have been copied in S3.
 func (h *submitHandler) loadMetaData() error {
 	// We need the SHA-256 hash of the Siphonfile so that we can grab
-	// it from the cache. Note that we can't do this query against the
-	// submission_id because the postgres rows haven't been copied yet.
-	// But that's OK because the hash is identical.
-	hash, err := GetFile(h.db, h.appID, "", MetadataName)
-	if err != nil {
-		log.Printf("[makeBundleFooter() GetFile error] %v", err)
-		return errors.New("Problem loading Siphonfile from the cache.")
+	// it from the cache.
+	hash := h.files[MetadataName]
+	if hash == "" {
+		return errors.New("A Siphonfile is required.")
 	}
 	b, err := h.submissionCache.Get(hash)
 	if err != nil {
@@ -120,15 +130,48 @@ func (h *submitHandler) loadMetaData() error {
 	return nil
 }
 
+// loadFiles works out which files we're submitting: either the ones the
+// job asked for, or the current development files. It returns the names
+// of any files the job asked for that are no longer stored.
+func (h *submitHandler) loadFiles() (missing []string, err error) {
+	if h.files == nil {
+		files, err := GetFiles(h.db, h.appID, "")
+		if err != nil {
+			log.Printf("[loadFiles() get files error]: %v", err)
+			return nil, errors.New("Problem retrieving files for the snapshot")
+		}
+		h.files, h.shared = files, map[string]bool{}
+		return nil, nil
+	}
+	// A push may have removed some blobs since the job was queued
+	shared, missing, err := checkSubmitFiles(h.db, h.devCache, h.appID,
+		h.files)
+	if err != nil {
+		return nil, err
+	}
+	h.shared = shared
+	return missing, nil
+}
+
 func (h *submitHandler) copyFiles() error {
 	// Copy the files to a submission namespace in S3 (as a side effect,
 	// also copies it in memcache).
-	files, err := GetFiles(h.db, h.appID, "")
-	if err != nil {
-		log.Printf("[copyFiles() get files error]: %v", err)
-		return errors.New("Problem copying files for the snapshot")
-	}
-	for _, hash := range files {
+	n := 0
+	for _, hash := range h.files {
+		// Copying is the bulk of the work, from 0% to 50%
+		if n%20 == 0 {
+			h.setProgress(n*50/len(h.files), "copy")
+		}
+		n++
+		// Blobs only another app stores are copied from that app
+		if h.shared[hash] {
+			if err := copySharedBlob(h.db, h.submissionCache,
+				hash); err != nil {
+				log.Printf("[copyFiles() shared blob error]: %v", err)
+				return errors.New("Problem copying files for the snapshot")
+			}
+			continue
+		}
 		b, err := h.devCache.Get(hash)
 		if err != nil {
 			log.Printf("[copyFiles() cache retrieve error]: %v", err)
@@ -143,7 +186,16 @@ func (h *submitHandler) copyFiles() error {
 	return nil
 }
 
-func (h *submitHandler) handle(r *http.Request) {
+func (h *submitHandler) handle() {
+	missing, err := h.loadFiles()
+	if err != nil {
+		h.internalError(err, "loadFiles()")
+		return
+	} else if len(missing) > 0 {
+		h.expectedError(missingFilesError(missing))
+		return
+	}
+
 	// Copy a snapshot of the files in S3 first.
 	if err := h.copyFiles(); err != nil {
 		h.internalError(err, "copyFiles()")
@@ -152,8 +204,9 @@ func (h *submitHandler) handle(r *http.Request) {
 
 	// Then grab the metadata (we need it for "base_version", which is
 	// needed to generate the bundle footer).
+	h.setProgress(50, "metadata")
 	if err := h.loadMetaData(); err != nil {
-		h.internalError(err, "loadMetaData()")
+		h.expectedError(err)
 		return
 	}
 
@@ -161,25 +214,122 @@ func (h *submitHandler) handle(r *http.Request) {
 	// here, rather than simply doing a blind copy, because /push is not
 	// properly atomic yet and the app source files may not match the bundle
 	// footer that's stored.
-	platform := r.PostFormValue("platform")
-	if platform == "" {
-		platform = "ios"
-	}
-	if err := h.makeBundleFooter(platform); err != nil {
+	h.setProgress(55, "footer")
+	if err := h.makeBundleFooters(); err != nil {
 		h.internalError(err, "makeBundleFooters()")
+		PostWebhookEvent(h.appID, WebhookEventBuildFailed, "", h.submissionID,
+			&WebhookBuildFailure{Stage: "submit", Error: err.Error()})
 		return
 	}
 
 	// If we got this far, all is good so copy the rows in postgres.
-	if err := MakeSnapshot(h.db, h.appID, h.submissionID); err != nil {
+	h.setProgress(90, "snapshot")
+	if err := MakeSnapshot(h.db, h.appID, h.submissionID,
+		h.files); err != nil {
 		h.internalError(err, "MakeSnapshot()")
 		return
 	}
+
+	// In case this submission was made before, drop any cached pulls of it
+	if err := InvalidatePullCache(h.db, h.submissionCache); err != nil {
+		log.Printf("(Ignored) InvalidatePullCache() error: %v", err)
+	}
+
+	// Let any webhooks and /v1/events/ clients know (fails silently)
+	PostWebhookEvent(h.appID, WebhookEventSubmit, "", h.submissionID, nil)
+	PublishAppEvent(h.appID, EventAppSubmitted, "", h.submissionID)
+}
+
+// checkSubmitFiles looks up where the blobs for `files` (name -> hash) are
+// stored, returning the hashes only another app stores (if dedup is
+// enabled) and the names of any files whose blob we no longer have. Blobs
+// no development file refers to any more are looked for in `cache`, since
+// a push only deletes a blob when it removes the last file with that hash.
+func checkSubmitFiles(db *sql.DB, cache *Cache, appID string,
+	files map[string]string) (shared map[string]bool, missing []string,
+	err error) {
+	hashes := []string{}
+	seen := map[string]bool{}
+	for _, hash := range files {
+		if !seen[hash] {
+			hashes = append(hashes, hash)
+		}
+		seen[hash] = true
+	}
+	own := map[string]bool{}
+	shared = map[string]bool{}
+	for len(hashes) > 0 {
+		// Look them up in batches to keep the queries a sensible size
+		n := len(hashes)
+		if n > maxMissingBlobsHashes {
+			n = maxMissingBlobsHashes
+		}
+		stored, err := GetStoredHashes(db, appID, hashes[:n])
+		if err != nil {
+			return nil, nil, err
+		}
+		others, err := sharedHashes(db, appID, hashes[:n])
+		if err != nil {
+			return nil, nil, err
+		}
+		for hash := range stored {
+			own[hash] = true
+		}
+		for hash := range others {
+			shared[hash] = true
+		}
+		hashes = hashes[n:]
+	}
+	missing = []string{}
+	for name, hash := range files {
+		if !own[hash] && !shared[hash] {
+			if _, err := cache.Get(hash); err == nil {
+				own[hash] = true
+				continue
+			}
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return shared, missing, nil
+}
+
+func missingFilesError(names []string) error {
+	return fmt.Errorf("Files are no longer stored: %s",
+		strings.Join(names, ", "))
+}
+
+// validManifestName checks that a submitted name is a safe path within the
+// app: not empty, not absolute and without ".." anywhere in it (the same
+// rule extraction applies to push archive entries).
+func validManifestName(name string) bool {
+	return name != "" && !path.IsAbs(name) && !strings.Contains(name, "..")
+}
+
+// Parses the explicit name -> hash manifest that may be submitted instead
+// of the development files.
+func parseSubmitManifest(s string) (files map[string]string, err error) {
+	if err := json.Unmarshal([]byte(s), &files); err != nil || files == nil {
+		return nil, errors.New("Malformed manifest.")
+	}
+	// Security/sanity check (the same as for a push's listing)
+	for name, hash := range files {
+		if !validManifestName(name) {
+			return nil, errors.New("Bad manifest name: " + name)
+		} else if hash == "" {
+			return nil, errors.New("Bad manifest SHA for: " + name)
+		}
+	}
+	return files, nil
 }
 
 // Submit handles the response for the /submit route, which is used to
 // make a snapshot of an app's current file listing, namespaced to a given
-// submission ID (one that is generated by the caller).
+// submission ID (one that is generated by the caller). Instead of the current
+// files, the caller may give a `revision` token (see /push) or a `manifest`
+// of name -> hash to submit exactly that state. The snapshot is made by a
+// job in the background (see runSubmitJob), so we respond straight away with
+// the job, which has a URL to poll for its status.
 func Submit(w http.ResponseWriter, r *http.Request) {
 	// Extract the required parameters. Note that `submission_id` comes from
 	// the POST payload.
@@ -190,6 +340,20 @@ func Submit(w http.ResponseWriter, r *http.Request) {
 			http.StatusBadRequest)
 		return
 	}
+	// Footers are built for every platform, so "platform" is only checked
+	// for older clients that still send it.
+	if _, err := RequestedPlatform(r.PostFormValue("platform")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Ensure that the submission ID in the payload matches the one
+	// in the handshake.
+	if context.Get(r, SubmissionIDKey) != submissionID {
+		http.Error(w, "Submission ID does not match the handshake.",
+			http.StatusBadRequest)
+		return
+	}
 
 	db := OpenDB() // we create/assign like this so we can use defer
 	defer db.Close()
@@ -200,8 +364,7 @@ func Submit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal error.", 500)
 		return
 	} else if exists {
-		http.Error(w, "Submission ID already exists.",
-			http.StatusBadRequest)
+		http.Error(w, errSubmissionExists.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -216,19 +379,67 @@ func Submit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Ensure that the submission ID in the payload matches the one
-	// in the handshake.
-	if context.Get(r, SubmissionIDKey) != submissionID {
-		http.Error(w, "Submission ID does not match the handshake.",
+	// Work out whether we're submitting a particular state of the app
+	// The worker has no request to take them from, so the job carries who
+	// asked for it and from where.
+	job := &SubmitJob{AppID: appID, SubmissionID: submissionID,
+		SourceIP: sourceIP(r)}
+	job.UserID, _ = context.Get(r, SubmitterIDKey).(string)
+	revision := parseETag(r.PostFormValue("revision"))
+	manifest := r.PostFormValue("manifest")
+	if revision != "" && manifest != "" {
+		http.Error(w, "Only one of revision and manifest may be given.",
 			http.StatusBadRequest)
 		return
+	} else if revision != "" {
+		files, err := GetRevision(db, appID, revision)
+		if err != nil {
+			http.Error(w, "Internal error.", 500)
+			return
+		} else if files == nil {
+			http.Error(w, "Unknown revision.", http.StatusBadRequest)
+			return
+		}
+		job.Files, job.Revision = files, revision
+	} else if manifest != "" {
+		files, err := parseSubmitManifest(manifest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job.Files, job.Revision = files, RevisionToken(files)
+	}
+	if job.Files != nil {
+		if job.Files[MetadataName] == "" {
+			http.Error(w, "A Siphonfile is required.", http.StatusBadRequest)
+			return
+		}
+		cache, err := NewCache(appID, "")
+		if err != nil {
+			http.Error(w, "Internal error.", 500)
+			return
+		}
+		_, missing, err := checkSubmitFiles(db, cache, appID, job.Files)
+		if err != nil {
+			http.Error(w, "Internal error.", 500)
+			return
+		} else if len(missing) > 0 {
+			http.Error(w, missingFilesError(missing).Error(),
+				http.StatusBadRequest)
+			return
+		}
 	}
 
-	h, err := newSubmitHandler(w, r, appID, submissionID)
-	if err != nil {
+	// Queue the job (which also fails if there's already a job for this
+	// submission ID)
+	if err := AddSubmitJob(db, job); err == errSubmissionExists {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Internal error.", 500)
 		return
 	}
-	h.db = db
-	h.handle(r)
+	wakeSubmitWorkers()
+	job.StatusURL = submitJobStatusURL(appID, job.ID)
+	writeJSON(w, job, http.StatusAccepted)
 }
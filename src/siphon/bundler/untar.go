@@ -0,0 +1,97 @@
+package bundler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Untar extracts a .tar (or .tar.gz if `gzipped` is true) file at `src` into
+// a directory `dest`. It applies the same path checks and `policy` as
+// Unzip().
+func Untar(src string, dest string, gzipped bool,
+	policy *ExtractPolicy) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	e, err := newExtractor(policy, src)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := extractTarEntry(e, header, dest, tr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTarEntry(e *extractor, header *tar.Header, dest string,
+	input io.Reader) error {
+	switch header.Typeflag {
+	case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName,
+		tar.TypeGNULongLink:
+		return nil // metadata, not an entry of its own
+	case tar.TypeLink:
+		return &ExtractError{header.Name, "hard links are not allowed"}
+	}
+
+	err := e.checkEntry(header.Name, header.FileInfo().Mode(), header.Size)
+	if err != nil {
+		return err
+	}
+
+	// Security checks
+	name := header.Name
+	if strings.Contains(name, "..") {
+		return errors.New("Bad tar listing name: " + header.Name)
+	}
+
+	name = filepath.Clean(strings.Replace(name, "../", "", -1)) // security
+	filePath := filepath.Join(dest, name)
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(filePath, e.policy.DirMode)
+	case tar.TypeReg, tar.TypeRegA: // older tar writers use TypeRegA
+		if err := os.MkdirAll(filepath.Dir(filePath),
+			e.policy.DirMode); err != nil {
+			return err
+		}
+		// Note that we ignore the mode in the archive
+		fileCopy, err := os.OpenFile(
+			filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, e.policy.FileMode)
+		if err != nil {
+			return err
+		}
+		defer fileCopy.Close()
+
+		return e.copy(fileCopy, input, header.Name)
+	}
+	return &ExtractError{header.Name, "unsupported entry type"}
+}
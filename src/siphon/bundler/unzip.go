@@ -7,29 +7,45 @@ import (
 	"archive/zip"
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-// Unzip extracts a .zip file at `src` into a directory `dest`.
-func Unzip(src string, dest string) error {
+// Unzip extracts a .zip file at `src` into a directory `dest`, rejecting
+// any entries that break the given `policy`.
+func Unzip(src string, dest string, policy *ExtractPolicy) error {
 	files, err := zip.OpenReader(src)
 	if err != nil {
 		return err
 	}
 	defer files.Close()
 
+	e, err := newExtractor(policy, src)
+	if err != nil {
+		return err
+	}
+
 	for _, file := range files.File {
 		err = func() error {
+			err := e.checkEntry(file.Name, file.Mode(),
+				int64(file.UncompressedSize64))
+			if err != nil {
+				return err
+			}
+			err = e.checkRatio(file.Name, int64(file.UncompressedSize64),
+				int64(file.CompressedSize64))
+			if err != nil {
+				return err
+			}
+
 			readCloser, err := file.Open()
 			if err != nil {
 				return err
 			}
 			defer readCloser.Close()
 
-			return extractFile(file, dest, readCloser)
+			return extractFile(e, file, dest, readCloser)
 		}()
 		if err != nil {
 			return err
@@ -38,7 +54,8 @@ func Unzip(src string, dest string) error {
 	return nil
 }
 
-func extractFile(file *zip.File, dest string, input io.Reader) error {
+func extractFile(e *extractor, file *zip.File, dest string,
+	input io.Reader) error {
 	// Security checks
 	name := file.Name
 	if strings.Contains(name, "..") {
@@ -50,35 +67,25 @@ func extractFile(file *zip.File, dest string, input io.Reader) error {
 	fileInfo := file.FileInfo()
 
 	if fileInfo.IsDir() {
-		err := os.MkdirAll(filePath, fileInfo.Mode())
+		err := os.MkdirAll(filePath, e.policy.DirMode)
 		if err != nil {
 			return err
 		}
 	} else {
-		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		err := os.MkdirAll(filepath.Dir(filePath), e.policy.DirMode)
 		if err != nil {
 			return err
 		}
 
-		if fileInfo.Mode()&os.ModeSymlink != 0 {
-			linkName, err := ioutil.ReadAll(input)
-			if err != nil {
-				return err
-			}
-			return os.Symlink(string(linkName), filePath)
-		}
-
+		// Note that we ignore the mode in the archive
 		fileCopy, err := os.OpenFile(
-			filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileInfo.Mode())
+			filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, e.policy.FileMode)
 		if err != nil {
 			return err
 		}
 		defer fileCopy.Close()
 
-		_, err = io.Copy(fileCopy, input)
-		if err != nil {
-			return err
-		}
+		return e.copy(fileCopy, input, file.Name)
 	}
 
 	return nil
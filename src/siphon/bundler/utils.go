@@ -37,6 +37,34 @@ func Cleanup(d string) {
 	}
 }
 
+// CopyFilesToTemp copies the files named in `files` (e.g. a subset of
+// those written by FilesToTemp()) from the directory `src` into a new temp
+// directory, whose path is returned. Files are hard linked where possible,
+// since they're never modified.
+func CopyFilesToTemp(src string, files map[string]string) (dir string,
+	err error) {
+	d, err := ioutil.TempDir("", "project-path")
+	if err != nil {
+		return "", err
+	}
+	for name := range files {
+		from, to := path.Join(src, name), path.Join(d, name)
+		os.MkdirAll(filepath.Dir(to), 0700) // make any intermediate dirs
+		if os.Link(from, to) == nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(from)
+		if err == nil {
+			err = ioutil.WriteFile(to, b, 0700)
+		}
+		if err != nil {
+			Cleanup(d)
+			return "", err
+		}
+	}
+	return d, nil
+}
+
 // FilesToTemp takes a map of {fileName: hash, ...} pairs, *sql.DB, *Archive
 // and *Cache and writes the files to a temp directory. The path of the
 // directory is returned
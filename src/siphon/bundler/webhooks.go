@@ -0,0 +1,497 @@
+package bundler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// Events that a webhook can subscribe to
+const (
+	WebhookEventPush        = "push"
+	WebhookEventSubmit      = "submit"
+	WebhookEventBuildFailed = "build_failed"
+	WebhookEventTest        = "test" // only sent by the test endpoint
+)
+
+// WebhookEvents are the events a webhook subscribes to by default.
+var WebhookEvents = []string{WebhookEventPush, WebhookEventSubmit,
+	WebhookEventBuildFailed}
+
+// How long we wait before each retry of a failed delivery. Note that retries
+// are only kept in memory, so any that are pending when the bundler stops
+// are lost (the delivery log shows which attempts were made).
+var webhookRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second,
+	2 * time.Minute}
+
+const webhookTimeout = 10 * time.Second
+const webhookDeliveriesLimit = 100
+
+// Webhook is a subscription to an app's events. Payloads are signed with
+// its secret, which is never sent back to the client.
+type Webhook struct {
+	ID      int64     `json:"id"`
+	AppID   string    `json:"app_id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Created time.Time `json:"created"`
+	secret  string
+}
+
+// WebhookDelivery is one attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	WebhookID  int64     `json:"webhook_id"`
+	AppID      string    `json:"app_id"`
+	DeliveryID string    `json:"delivery_id"` // the same for each retry
+	Event      string    `json:"event"`
+	Payload    string    `json:"payload"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"` // 0 if there was no response
+	Error      string    `json:"error"`
+	Created    time.Time `json:"created"`
+}
+
+// WebhookPayload is the JSON body POST'd to a webhook's URL.
+type WebhookPayload struct {
+	DeliveryID   string      `json:"delivery_id"`
+	Event        string      `json:"event"`
+	AppID        string      `json:"app_id"`
+	UserID       string      `json:"user_id,omitempty"`
+	SubmissionID string      `json:"submission_id,omitempty"`
+	Timestamp    time.Time   `json:"timestamp"`
+	Data         interface{} `json:"data,omitempty"`
+}
+
+// WebhookBuildFailure is the data sent with a "build_failed" event.
+type WebhookBuildFailure struct {
+	Stage string `json:"stage"` // "push" or "submit"
+	Error string `json:"error"`
+}
+
+func (h *Webhook) subscribes(event string) bool {
+	if event == WebhookEventTest {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// SignWebhookPayload returns the value of the X-Siphon-Signature header for
+// the given payload, which receivers should check with the same secret. The
+// signature covers the X-Siphon-Timestamp header's value (Unix seconds)
+// followed by a "." and the body, so receivers can reject old deliveries
+// that are being replayed.
+func SignWebhookPayload(secret string, timestamp string, b []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(b)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookHostsRestricted returns true if webhooks may only be delivered to
+// public addresses. Tests deliver to a local server, so they're exempt.
+func webhookHostsRestricted() bool {
+	return os.Getenv("SIPHON_ENV") != "testing"
+}
+
+// Address ranges that aren't covered by the net.IP methods we check, but
+// which aren't public either.
+var privateNetworks = []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10",
+	"172.16.0.0/12", "192.168.0.0/16", "198.18.0.0/15", "fc00::/7"}
+
+// isPublicIP returns false for loopback, private, link-local (e.g. cloud
+// metadata services) and other addresses that webhooks mustn't reach.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, cidr := range privateNetworks {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+var errWebhookHost = errors.New("The webhook URL must be for a public " +
+	"address.")
+
+// resolvePublicHost returns an address for `host`, or errWebhookHost if it
+// resolves to any address that isn't public.
+func resolvePublicHost(host string) (net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return nil, errors.New("The webhook URL's host could not be found.")
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return nil, errWebhookHost
+		}
+	}
+	return ips[0], nil
+}
+
+// dialWebhook connects to a webhook's host, checking the address again at
+// delivery time (the host may resolve differently since it was added, and
+// redirects may point anywhere).
+func dialWebhook(network string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !webhookHostsRestricted() {
+		return dialer.Dial(network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := resolvePublicHost(host)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+}
+
+var webhookClient = &http.Client{
+	Timeout:   webhookTimeout,
+	Transport: &http.Transport{Dial: dialWebhook},
+}
+
+// randomID returns a random hex string, e.g. for delivery IDs.
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// attempt makes a single delivery attempt and logs it.
+func (h *Webhook) attempt(db *sql.DB, p *WebhookPayload, b []byte,
+	attempt int) *WebhookDelivery {
+	d := &WebhookDelivery{WebhookID: h.ID, AppID: h.AppID,
+		DeliveryID: p.DeliveryID, Event: p.Event, Payload: string(b),
+		Attempt: attempt, Created: time.Now()}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(b))
+	if err == nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "siphon-bundler")
+		req.Header.Set("X-Siphon-Event", p.Event)
+		req.Header.Set("X-Siphon-Delivery", p.DeliveryID)
+		req.Header.Set("X-Siphon-Timestamp", timestamp)
+		req.Header.Set("X-Siphon-Signature",
+			SignWebhookPayload(h.secret, timestamp, b))
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if resp != nil {
+			d.StatusCode = resp.StatusCode
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+	// The details of a failed request would tell the client about the
+	// network we're on, so they only go in our own log.
+	if err != nil {
+		log.Printf("[webhook %d delivery error] %v", h.ID, err)
+		d.Error = "The request failed."
+	} else if d.StatusCode < 200 || d.StatusCode > 299 {
+		d.Error = fmt.Sprintf("Unexpected HTTP %d response.", d.StatusCode)
+	}
+	if err := AddWebhookDelivery(db, d); err != nil {
+		log.Printf("(ignored) Failed to log webhook delivery: %v", err)
+	}
+	return d
+}
+
+// deliver sends the payload to the webhook, retrying if it fails.
+func (h *Webhook) deliver(db *sql.DB, p *WebhookPayload) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("(ignored) Failed to serialize webhook payload: %v", err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		d := h.attempt(db, p, b, attempt)
+		if d.Error == "" || attempt > len(webhookRetryDelays) {
+			if d.Error != "" {
+				log.Printf("(ignored) Giving up on webhook %d: %s", h.ID,
+					d.Error)
+			}
+			return
+		}
+		time.Sleep(webhookRetryDelays[attempt-1])
+	}
+}
+
+// PostWebhookEvent delivers an event to each of the app's webhooks that
+// subscribes to it. It returns immediately and fails silently, like
+// PostAppUpdated(); see the delivery log for what happened.
+func PostWebhookEvent(appID string, event string, userID string,
+	submissionID string, data interface{}) {
+	go func() {
+		db := OpenDB()
+		defer db.Close()
+		hooks, err := GetWebhooks(db, appID, 0)
+		if err != nil {
+			log.Printf("(ignored) Failed to load webhooks: %v", err)
+			return
+		}
+		p := &WebhookPayload{DeliveryID: randomID(), Event: event,
+			AppID: appID, UserID: userID, SubmissionID: submissionID,
+			Timestamp: time.Now().UTC(), Data: data}
+		// Each webhook gets its own goroutine, so that one that's retrying
+		// doesn't hold up the others.
+		done := make(chan bool)
+		n := 0
+		for _, hook := range hooks {
+			if hook.subscribes(event) {
+				go func(hook *Webhook) {
+					hook.deliver(db, p)
+					done <- true
+				}(hook)
+				n++
+			}
+		}
+		for ; n > 0; n-- {
+			<-done
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}, code int) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		log.Printf("Failed to serialize response: %v", err)
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// webhookRequest extracts the app ID (and webhook ID, if present in the
+// URL) for the webhook routes, which need a development handshake.
+func webhookRequest(w http.ResponseWriter, r *http.Request) (appID string,
+	id int64, ok bool) {
+	if _, ok := context.GetOk(r, UserIDKey); !ok {
+		http.Error(w, "Webhooks require a development handshake.",
+			http.StatusUnauthorized)
+		return "", 0, false
+	}
+	appID = context.Get(r, AppIDKey).(string)
+	if s, ok := mux.Vars(r)["webhook_id"]; ok {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid webhook ID.", http.StatusBadRequest)
+			return "", 0, false
+		}
+		id = n
+	}
+	return appID, id, true
+}
+
+// loadWebhook fetches the webhook in the URL, writing a 404 if there is no
+// such webhook for this app.
+func loadWebhook(w http.ResponseWriter, db *sql.DB, appID string,
+	id int64) *Webhook {
+	hooks, err := GetWebhooks(db, appID, id)
+	if err != nil {
+		http.Error(w, "Internal error.", 500)
+		return nil
+	} else if len(hooks) == 0 {
+		http.Error(w, "Webhook not found.", http.StatusNotFound)
+		return nil
+	}
+	return hooks[0]
+}
+
+// parseWebhook validates a new webhook subscription from a JSON payload.
+func parseWebhook(r *http.Request, appID string) (*Webhook, error) {
+	var obj struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(b, &obj)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Malformed payload.")
+	}
+	u, err := url.Parse(obj.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return nil, fmt.Errorf("The webhook URL must be an absolute http or " +
+			"https URL.")
+	}
+	if webhookHostsRestricted() {
+		host := u.Host
+		if h, _, err := net.SplitHostPort(u.Host); err == nil {
+			host = h
+		}
+		if _, err := resolvePublicHost(host); err != nil {
+			return nil, err
+		}
+	}
+	if len(obj.Secret) < 16 {
+		return nil, fmt.Errorf("The webhook secret must be at least 16 " +
+			"characters long.")
+	}
+	if len(obj.Events) == 0 {
+		obj.Events = WebhookEvents
+	}
+	for _, event := range obj.Events {
+		known := false
+		for _, e := range WebhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown webhook event: %s (expected one "+
+				"of %s)", event, strings.Join(WebhookEvents, ", "))
+		}
+	}
+	return &Webhook{AppID: appID, URL: obj.URL, Events: obj.Events,
+		secret: obj.Secret}, nil
+}
+
+// Webhooks handles a response for the /webhooks/{app_id}/ route, listing
+// the app's webhooks (GET) or subscribing a new one (POST).
+func Webhooks(w http.ResponseWriter, r *http.Request) {
+	appID, _, ok := webhookRequest(w, r)
+	if !ok {
+		return
+	}
+	db := OpenDB()
+	defer db.Close()
+
+	if r.Method == "GET" {
+		hooks, err := GetWebhooks(db, appID, 0)
+		if err != nil {
+			http.Error(w, "Internal error.", 500)
+			return
+		}
+		writeJSON(w, hooks, http.StatusOK)
+		return
+	}
+
+	hook, err := parseWebhook(r, appID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := AddWebhook(db, hook); err != nil {
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	RecordAudit(r, &AuditEntry{Action: AuditWebhookAdd, AppID: appID,
+		Outcome: AuditSuccess, Message: fmt.Sprintf("Webhook %d: %s",
+			hook.ID, hook.URL)})
+	writeJSON(w, hook, http.StatusCreated)
+}
+
+// DeleteWebhookHandler handles a response for the
+// /webhooks/{app_id}/{webhook_id}/ route, which unsubscribes a webhook.
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	appID, id, ok := webhookRequest(w, r)
+	if !ok {
+		return
+	}
+	db := OpenDB()
+	defer db.Close()
+	hook := loadWebhook(w, db, appID, id)
+	if hook == nil {
+		return
+	}
+	if err := DeleteWebhook(db, appID, id); err != nil {
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	RecordAudit(r, &AuditEntry{Action: AuditWebhookDelete, AppID: appID,
+		Outcome: AuditSuccess, Message: fmt.Sprintf("Webhook %d: %s",
+			hook.ID, hook.URL)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebhookDeliveries handles a response for the
+// /webhooks/{app_id}/{webhook_id}/deliveries/ route, returning the most
+// recent delivery attempts.
+func WebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	appID, id, ok := webhookRequest(w, r)
+	if !ok {
+		return
+	}
+	db := OpenDB()
+	defer db.Close()
+	if loadWebhook(w, db, appID, id) == nil {
+		return
+	}
+	deliveries, err := GetWebhookDeliveries(db, appID, id,
+		webhookDeliveriesLimit)
+	if err != nil {
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	writeJSON(w, deliveries, http.StatusOK)
+}
+
+// WebhookTestResult is the response to a test delivery. Whatever went wrong
+// is deliberately left out, see the delivery log for the status code.
+type WebhookTestResult struct {
+	DeliveryID string `json:"delivery_id"`
+	Success    bool   `json:"success"`
+}
+
+// TestWebhook handles a response for the
+// /webhooks/{app_id}/{webhook_id}/test/ route. It makes a single delivery
+// of a "test" event and returns whether it succeeded, without retrying.
+func TestWebhook(w http.ResponseWriter, r *http.Request) {
+	appID, id, ok := webhookRequest(w, r)
+	if !ok {
+		return
+	}
+	db := OpenDB()
+	defer db.Close()
+	hook := loadWebhook(w, db, appID, id)
+	if hook == nil {
+		return
+	}
+	userID, _ := context.Get(r, UserIDKey).(string)
+	p := &WebhookPayload{DeliveryID: randomID(),
+		Event: WebhookEventTest, AppID: appID, UserID: userID,
+		Timestamp: time.Now().UTC()}
+	b, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, "Internal error.", 500)
+		return
+	}
+	d := hook.attempt(db, p, b, 1)
+	writeJSON(w, &WebhookTestResult{DeliveryID: d.DeliveryID,
+		Success: d.Error == ""}, http.StatusOK)
+}
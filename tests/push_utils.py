@@ -1,5 +1,6 @@
 
 import os
+import tarfile
 import zipfile
 import hashlib
 import json
@@ -13,21 +14,50 @@ def get_hashes(bundler_url):
     resp = requests.get(bundler_url)
     return resp.json()['hashes']
 
-def post_archive_with_listing(bundler_url, files):
+def post_archive_with_listing(bundler_url, files, headers=None,
+                              hash_only=None):
+    """
+    Pushes `files` (name -> content), but only lists the names in
+    `hash_only` without sending their content.
+    """
     fp = BytesIO()
     listing = {}
     with zipfile.ZipFile(fp, 'w') as zf:
         for name, content in files.items():
             listing[name] = sha256_str(content)
-            zf.writestr('diffs/' + name, content)
+            if name not in (hash_only or []):
+                zf.writestr('diffs/' + name, content)
         zf.writestr('listing.json', json.dumps(listing))
     fp.seek(0)
+    all_headers = {'Accept-Encoding': 'gzip;q=0,deflate,sdch'}
+    all_headers.update(headers or {})
+    response = requests.post(bundler_url, data=fp, headers=all_headers)
+    fp.close()
+    return response
+
+def post_tarball_with_listing(bundler_url, files, tar_type=tarfile.REGTYPE):
+    fp = BytesIO()
+    listing = {}
+    with tarfile.open(fileobj=fp, mode='w:gz') as tf:
+        for name, content in files.items():
+            listing[name] = sha256_str(content)
+            _add_tar_string(tf, 'diffs/' + name, content, tar_type)
+        _add_tar_string(tf, 'listing.json', json.dumps(listing), tar_type)
+    fp.seek(0)
     response = requests.post(bundler_url, data=fp, headers={
+        'Content-Type': 'application/gzip',
         'Accept-Encoding': 'gzip;q=0,deflate,sdch'
     })
     fp.close()
     return response
 
+def _add_tar_string(tf, name, content, tar_type=tarfile.REGTYPE):
+    b = content.encode('utf-8')
+    info = tarfile.TarInfo(name)
+    info.type = tar_type
+    info.size = len(b)
+    tf.addfile(info, BytesIO(b))
+
 def post_archive(app_dir, bundler_url, server_hashes):
     """ Stolen from `siphon.cli.commands.push` """
     previous_dir = os.getcwd()
@@ -0,0 +1,86 @@
+import requests
+
+from utils import BundlerTestCase, make_development_handshake, \
+    make_production_handshake, submit_and_wait
+from push_utils import post_archive_with_listing
+
+
+class TestAudit(BundlerTestCase):
+    def _make_url(self, action, app_id):
+        token, signature = make_development_handshake(action, 'testuser',
+            app_id)
+        return 'http://localhost:8000/v1/%s/%s/?handshake_token=%s' \
+            '&handshake_signature=%s' % (action, app_id, token, signature)
+
+    def _push(self, app_id, files):
+        resp = post_archive_with_listing(self._make_url('push', app_id), files)
+        self.assertEqual(resp.status_code, 200)
+
+    def test_audit__push(self):
+        """ Pushes are recorded along with the files they affected. """
+        app_id = 'test-audit-push'
+        self._push(app_id, {
+            'a.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self._push(app_id, {
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        resp = requests.get(self._make_url('audit', app_id))
+        self.assertEqual(resp.status_code, 200)
+        entries = resp.json()['entries']
+        self.assertEqual(len(entries), 2)
+        # Newest first
+        self.assertEqual(entries[0]['action'], 'push')
+        self.assertEqual(entries[0]['outcome'], 'success')
+        self.assertEqual(entries[0]['user_id'], 'user_id')
+        self.assertListEqual(entries[0]['files']['removed'], ['a.js'])
+        self.assertListEqual(sorted(entries[1]['files']['added']),
+            ['Siphonfile', 'a.js'])
+
+    def test_audit__submit(self):
+        """
+        Submits run in the background, but are still recorded with the user
+        named in the handshake.
+        """
+        app_id = 'test-audit-submit'
+        submission_id = 'test-audit-submit-id'
+        self._push(app_id, {
+            'a.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        token, signature = make_production_handshake('submit', submission_id,
+            app_id, user_id='submitter')
+        job = submit_and_wait('http://localhost:8000/v1/submit/%s/' \
+            '?handshake_token=%s&handshake_signature=%s' % (app_id, token,
+            signature), {'submission_id': submission_id})
+        self.assertEqual(job['status'], 'succeeded')
+
+        entries = requests.get(self._make_url('audit', app_id) +
+            '&user_id=submitter').json()['entries']
+        self.assertEqual(len(entries), 1)
+        self.assertEqual(entries[0]['action'], 'submit')
+        self.assertEqual(entries[0]['outcome'], 'success')
+        self.assertEqual(entries[0]['submission_id'], submission_id)
+        self.assertTrue(entries[0]['source_ip'])
+
+    def test_audit__pagination(self):
+        app_id = 'test-audit-pagination'
+        for content in ('one', 'two', 'three'):
+            self._push(app_id, {
+                'a.js': content,
+                'Siphonfile': '{"base_version": "0.3"}'
+            })
+        url = self._make_url('audit', app_id)
+        page = requests.get(url + '&limit=2').json()
+        self.assertEqual(len(page['entries']), 2)
+        page = requests.get(url + '&limit=2&before=%d' % page['next']).json()
+        self.assertEqual(len(page['entries']), 1)
+        self.assertTrue('next' not in page)
+
+    def test_audit__filter_by_user(self):
+        app_id = 'test-audit-filter'
+        self._push(app_id, {'Siphonfile': '{"base_version": "0.3"}'})
+        url = self._make_url('audit', app_id)
+        entries = requests.get(url + '&user_id=someone-else').json()['entries']
+        self.assertEqual(len(entries), 0)
@@ -0,0 +1,66 @@
+import io
+import zipfile
+
+import requests
+
+from utils import BundlerTestCase, make_development_handshake, \
+    make_production_handshake, count_files, submit_and_wait
+from push_utils import get_hashes, post_archive
+
+APP_FILES_DEFAULT = 'test-data/push-files'
+
+
+class TestClone(BundlerTestCase):
+    def _make_url(self, action, app_id):
+        token, signature = make_development_handshake(action, 'testuser',
+            app_id)
+        return 'http://localhost:8000/v1/%s/%s/?handshake_token=%s' \
+            '&handshake_signature=%s' % (action, app_id, token, signature)
+
+    def _push(self, app_id):
+        push_url = self._make_url('push', app_id)
+        post_archive(APP_FILES_DEFAULT, push_url, get_hashes(push_url))
+
+    def test_clone(self):
+        """ Every file comes back with its path and content intact. """
+        app_id = 'test-clone-app'
+        self._push(app_id)
+        resp = requests.get(self._make_url('clone', app_id))
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(resp.headers['Content-Type'], 'application/zip')
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            names = zf.namelist()
+            self.assertEqual(len(names), count_files(APP_FILES_DEFAULT))
+            self.assertTrue('Siphonfile' in names)
+            self.assertTrue('components/CardView.js' in names)
+            with open(APP_FILES_DEFAULT + '/index.ios.js', 'rb') as fp:
+                self.assertEqual(zf.read('index.ios.js'), fp.read())
+
+    def test_clone__wrong_action(self):
+        """ A pull handshake can't be used to clone. """
+        app_id = 'test-clone-wrong-action'
+        self._push(app_id)
+        url = self._make_url('pull', app_id).replace('/pull/', '/clone/')
+        resp = requests.get(url)
+        self.assertEqual(resp.status_code, 401)
+
+    def test_clone__submission(self):
+        app_id = 'test-clone-submission-app'
+        submission_id = 'test-clone-submission'
+        self._push(app_id)
+        token, signature = make_production_handshake('submit', submission_id,
+            app_id)
+        job = submit_and_wait('http://localhost:8000/v1/submit/%s/' \
+            '?handshake_token=%s&handshake_signature=%s' % (app_id, token,
+            signature), {'submission_id': submission_id})
+        self.assertEqual(job['status'], 'succeeded')
+
+        token, signature = make_production_handshake('clone', submission_id,
+            app_id)
+        resp = requests.get('http://localhost:8000/v1/clone/%s/' \
+            '?handshake_token=%s&handshake_signature=%s&submission_id=%s' % (
+            app_id, token, signature, submission_id))
+        self.assertEqual(resp.status_code, 200)
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            self.assertEqual(len(zf.namelist()),
+                count_files(APP_FILES_DEFAULT))
@@ -0,0 +1,97 @@
+import json
+import requests
+
+from utils import BundlerTestCase, make_development_handshake, \
+    make_production_handshake, submit_and_wait
+from push_utils import post_archive_with_listing
+
+
+class TestEvents(BundlerTestCase):
+    def _make_url(self, action, app_id):
+        token, signature = make_development_handshake(action, 'testuser',
+            app_id)
+        return 'http://localhost:8000/v1/%s/%s/?handshake_token=%s' \
+            '&handshake_signature=%s' % (action, app_id, token, signature)
+
+    def _push(self, app_id, files):
+        resp = post_archive_with_listing(self._make_url('push', app_id), files)
+        self.assertEqual(resp.status_code, 200)
+
+    def test_events__long_poll(self):
+        """ Recent events are replayed after the last event ID. """
+        app_id = 'test-events-long-poll'
+        self._push(app_id, {
+            'a.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        events_url = self._make_url('events', app_id)
+        resp = requests.get(events_url + '&last_event_id=0')
+        self.assertEqual(resp.status_code, 200)
+        events = resp.json()['events']
+        self.assertEqual(len(events), 1)
+        self.assertEqual(events[0]['type'], 'app_updated')
+        self.assertEqual(events[0]['app_id'], app_id)
+        self.assertTrue(events[0]['user_id'])
+
+        # Nothing new since then, so we time out with no events
+        resp = requests.get(events_url + '&timeout=1&last_event_id=%d' %
+            events[0]['id'])
+        self.assertEqual(resp.status_code, 200)
+        self.assertListEqual(resp.json()['events'], [])
+
+    def test_events__stream(self):
+        """ Clients accepting text/event-stream get Server-Sent Events. """
+        app_id = 'test-events-stream'
+        self._push(app_id, {
+            'a.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        resp = requests.get(self._make_url('events', app_id), headers={
+            'Accept': 'text/event-stream',
+            'Last-Event-ID': '0'
+        }, stream=True, timeout=5)
+        resp.encoding = 'utf-8'
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(resp.headers['Content-Type'], 'text/event-stream')
+
+        lines = []
+        for line in resp.iter_lines(decode_unicode=True):
+            if not line:
+                break
+            lines.append(line)
+        resp.close()
+        self.assertTrue(lines[0].startswith('id: '))
+        self.assertEqual(lines[1], 'event: app_updated')
+        data = json.loads(lines[2][len('data: '):])
+        self.assertEqual(data['app_id'], app_id)
+
+    def test_events__submit(self):
+        """ Submits are published too, with their submission ID. """
+        app_id = 'test-events-submit'
+        submission_id = 'test-events-submit-id'
+        self._push(app_id, {
+            'a.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        token, signature = make_production_handshake('submit', submission_id,
+            app_id)
+        job = submit_and_wait('http://localhost:8000/v1/submit/%s/' \
+            '?handshake_token=%s&handshake_signature=%s' % (app_id, token,
+            signature), {'submission_id': submission_id})
+        self.assertEqual(job['status'], 'succeeded')
+
+        resp = requests.get(self._make_url('events', app_id) +
+            '&last_event_id=0')
+        self.assertEqual(resp.status_code, 200)
+        events = resp.json()['events']
+        self.assertListEqual([e['type'] for e in events],
+            ['app_updated', 'app_submitted'])
+        self.assertEqual(events[1]['submission_id'], submission_id)
+        self.assertTrue(events[0]['id'] < events[1]['id'])
+
+    def test_events__wrong_action(self):
+        """ The handshake has to be for "events". """
+        app_id = 'test-events-wrong-action'
+        url = self._make_url('pull', app_id).replace('/pull/', '/events/')
+        resp = requests.get(url)
+        self.assertEqual(resp.status_code, 401)
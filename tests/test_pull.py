@@ -1,12 +1,49 @@
 
+import base64
+import hashlib
 import io
 import json
+import os
 import unittest
 import requests
 import zipfile
 
 from utils import BundlerTestCase, make_development_handshake
-from push_utils import get_hashes, post_archive
+from push_utils import get_hashes, post_archive, post_archive_with_listing
+
+
+def _read_uvarint(b, i):
+    n, shift = 0, 0
+    while True:
+        c = b[i]
+        i += 1
+        n |= (c & 0x7f) << shift
+        if c < 0x80:
+            return n, i
+        shift += 7
+
+
+def apply_delta(old, delta):
+    """ Applies a footer delta (see delta.go), checking the new hash. """
+    assert delta[:4] == b'SDL1'
+    size, i = _read_uvarint(delta, 4)
+    end = len(delta) - 32
+    out = b''
+    while len(out) < size:
+        op = delta[i]
+        if op == 0x01:
+            offset, i = _read_uvarint(delta, i + 1)
+            length, i = _read_uvarint(delta, i)
+            out += old[offset:offset + length]
+        elif op == 0x02:
+            length, i = _read_uvarint(delta, i + 1)
+            out += delta[i:i + length]
+            i += length
+        else:
+            raise ValueError('Unknown delta op: %d' % op)
+    assert i == end and len(out) == size
+    assert hashlib.sha256(out).digest() == delta[end:]
+    return out
 
 
 class TestPull(BundlerTestCase):
@@ -43,13 +80,19 @@ class TestPull(BundlerTestCase):
         # the files we're expecting.
         self.assertEqual(resp.status_code, 200)
         self.assertEqual(resp.headers['Content-Type'], 'application/zip')
-        self.assertEqual(len(resp.content), 58202)
+        self.assertEqual(len(resp.content), 58177)
 
         with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
             names = zf.namelist()
             self.assertListEqual(names, ['__siphon_assets/images/landscape.png',
                 'assets-listing', 'bundle-footer'])
 
+            # Images are already compressed, so they're stored as-is
+            info = zf.getinfo('__siphon_assets/images/landscape.png')
+            self.assertEqual(info.compress_type, zipfile.ZIP_STORED)
+            self.assertEqual(zf.getinfo('bundle-footer').compress_type,
+                zipfile.ZIP_DEFLATED)
+
     def test_pull__with_existing_assets(self):
         """ Emulates a pull where we already have an asset locally. """
         app_id = 'test-app-for-pull-assets'
@@ -65,3 +108,281 @@ class TestPull(BundlerTestCase):
         with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
             names = zf.namelist()
             self.assertListEqual(names, ['assets-listing', 'bundle-footer'])
+
+    def _push_files(self, app_id, files):
+        # Pushes need a Siphonfile, so add a minimal one if it's missing
+        files = dict(files)
+        files.setdefault('Siphonfile', '{"base_version": "0.3"}')
+        resp = post_archive_with_listing(self._make_url('push', app_id), files)
+        self.assertEqual(resp.status_code, 200)
+        pull_url = self._make_url('pull', app_id)
+        headers = {'content-type': 'application/json'}
+        resp = requests.post(pull_url, headers=headers, data=json.dumps({
+            'asset_hashes': {}
+        }))
+        self.assertEqual(resp.status_code, 200)
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            return sorted(zf.namelist())
+
+    def test_pull__default_asset_types(self):
+        """ Fonts, audio and video are assets by default, not just images. """
+        names = self._push_files('test-app-for-pull-asset-types', {
+            'fonts/Lato.ttf': 'font-content',
+            'sounds/ding.mp3': 'audio-content',
+            'data.json': '{}',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertListEqual(names, [
+            '__siphon_assets/images/fonts/Lato.ttf',
+            '__siphon_assets/images/sounds/ding.mp3',
+            'assets-listing', 'bundle-footer'])
+
+    def test_pull__custom_asset_types(self):
+        """ The Siphonfile can replace the default asset types. """
+        names = self._push_files('test-app-for-pull-custom-asset-types', {
+            'image.png': 'image-content',
+            'data.json': '{}',
+            'Siphonfile': '{"base_version": "0.3", ' \
+                          '"asset_extensions": ["json"]}'
+        })
+        self.assertListEqual(names, ['__siphon_assets/images/data.json',
+            'assets-listing', 'bundle-footer'])
+
+    def _pull_with_footer_hash(self, app_id, footer_hash):
+        pull_url = self._make_url('pull', app_id)
+        headers = {'content-type': 'application/json'}
+        resp = requests.post(pull_url, headers=headers, data=json.dumps({
+            'asset_hashes': {},
+            'footer_hash': footer_hash
+        }))
+        self.assertEqual(resp.status_code, 200)
+        return zipfile.ZipFile(io.BytesIO(resp.content))
+
+    def test_pull__unknown_footer_hash(self):
+        """ A footer hash we don't know about gets the full footer. """
+        app_id = 'test-app-for-pull-unknown-footer'
+        self._push_files(app_id, {'index.js': 'a'})
+        with self._pull_with_footer_hash(app_id, 'a' * 64) as zf:
+            self.assertListEqual(zf.namelist(),
+                ['assets-listing', 'bundle-footer'])
+
+    def test_pull__current_footer_hash(self):
+        """ A delta is only sent when it's smaller than the footer itself. """
+        app_id = 'test-app-for-pull-current-footer'
+        self._push_files(app_id, {'index.js': 'a'})
+        with self._pull_with_footer_hash(app_id, '') as zf:
+            footer = zf.read('bundle-footer')
+        footer_hash = hashlib.sha256(footer).hexdigest()
+
+        # A footer this small isn't worth a delta
+        self._push_files(app_id, {'index.js': 'b'})
+        with self._pull_with_footer_hash(app_id, footer_hash) as zf:
+            self.assertListEqual(zf.namelist(),
+                ['assets-listing', 'bundle-footer'])
+            self.assertTrue(zf.read('bundle-footer').endswith(b'b'))
+
+    def test_pull__footer_delta(self):
+        """ A client with an older footer gets a delta that patches it. """
+        app_id = 'test-app-for-pull-footer-delta'
+        # The dummy footer in testing includes index.js
+        lines = ['var line%d = %d;' % (i, i) for i in range(1000)]
+        self._push_files(app_id, {'index.js': '\n'.join(lines)})
+        with self._pull_with_footer_hash(app_id, '') as zf:
+            old = zf.read('bundle-footer')
+
+        lines[500] = 'var changed = true;'
+        self._push_files(app_id, {'index.js': '\n'.join(lines)})
+        with self._pull_with_footer_hash(app_id,
+                hashlib.sha256(old).hexdigest()) as zf:
+            self.assertListEqual(zf.namelist(),
+                ['assets-listing', 'bundle-footer.delta'])
+            delta = zf.read('bundle-footer.delta')
+        self.assertTrue(len(delta) < len(old) / 10)
+        new = apply_delta(old, delta)
+        self.assertTrue(b'var changed = true;' in new)
+
+        # Which is the same as the full footer a new client gets
+        with self._pull_with_footer_hash(app_id, '') as zf:
+            self.assertEqual(zf.read('bundle-footer'), new)
+
+    def test_pull__cached(self):
+        """ Identical pulls are served from the cache until the next push. """
+        app_id = 'test-app-for-pull-cache'
+        self._push_files(app_id, {'image.png': 'a'})
+        pull_url = self._make_url('pull', app_id)
+        headers = {'content-type': 'application/json'}
+        payload = json.dumps({'asset_hashes': {}})
+
+        # _push_files() has already made this pull once
+        first = requests.post(pull_url, headers=headers, data=payload)
+        self.assertEqual(first.headers['X-Siphon-Pull-Cache'], 'hit')
+        second = requests.post(pull_url, headers=headers, data=payload)
+        self.assertEqual(second.headers['X-Siphon-Pull-Cache'], 'hit')
+        self.assertEqual(first.content, second.content)
+
+        # Different asset hashes get a different response
+        resp = requests.post(pull_url, headers=headers, data=json.dumps({
+            'asset_hashes': {'images/image.png': 'x'}
+        }))
+        self.assertEqual(resp.headers['X-Siphon-Pull-Cache'], 'miss')
+
+        # A push invalidates everything (again, _push_files() pulls after it)
+        self._push_files(app_id, {'image.png': 'b'})
+        resp = requests.post(pull_url, headers=headers, data=payload)
+        self.assertEqual(resp.headers['X-Siphon-Pull-Cache'], 'hit')
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            self.assertEqual(zf.read('__siphon_assets/images/image.png'),
+                b'b')
+
+    def test_pull__cached_large(self):
+        """
+        Responses bigger than a memcache item (1MB) are cached too, and are
+        still replaced after a push.
+        """
+        app_id = 'test-app-for-pull-cache-large'
+        big = base64.b64encode(os.urandom(1536 * 1024)).decode()
+        self._push_files(app_id, {'image.png': big})
+        pull_url = self._make_url('pull', app_id)
+        headers = {'content-type': 'application/json'}
+        payload = json.dumps({'asset_hashes': {}})
+
+        # _push_files() has already made this pull once
+        resp = requests.post(pull_url, headers=headers, data=payload)
+        self.assertEqual(resp.status_code, 200)
+        self.assertTrue(len(resp.content) > 1024 * 1024)
+        self.assertEqual(resp.headers['X-Siphon-Pull-Cache'], 'hit')
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            self.assertEqual(zf.read('__siphon_assets/images/image.png'),
+                big.encode())
+
+        self._push_files(app_id, {'image.png': big[::-1]})
+        resp = requests.post(pull_url, headers=headers, data=payload)
+        self.assertEqual(resp.headers['X-Siphon-Pull-Cache'], 'hit')
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            self.assertEqual(zf.read('__siphon_assets/images/image.png'),
+                big[::-1].encode())
+
+    def test_pull__manifest(self):
+        """ Manifest mode returns signed URLs instead of a zip. """
+        app_id = 'test-app-for-pull-manifest'
+        self._push_files(app_id, {'a.png': 'image-a', 'b.png': 'image-b',
+                                  'index.js': 'js'})
+        pull_url = self._make_url('pull', app_id) + '&mode=manifest'
+        headers = {'content-type': 'application/json'}
+        resp = requests.post(pull_url, headers=headers, data=json.dumps({
+            'asset_hashes': {
+                'images/a.png': hashlib.sha256(b'image-a').hexdigest()
+            }
+        }))
+        self.assertEqual(resp.status_code, 200)
+        manifest = resp.json()
+        self.assertListEqual(manifest['assets_listing'],
+            ['images/a.png', 'images/b.png'])
+
+        # We only need b.png, and each file can be fetched on its own
+        self.assertEqual(len(manifest['assets']), 1)
+        asset = manifest['assets'][0]
+        self.assertEqual(asset['name'], '__siphon_assets/images/b.png')
+        resp = requests.get(asset['url'])
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(resp.content, b'image-b')
+        self.assertEqual(hashlib.sha256(resp.content).hexdigest(),
+            asset['hash'])
+
+        footer = manifest['footer']
+        self.assertEqual(footer['name'], 'bundle-footer')
+        resp = requests.get(footer['url'])
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(hashlib.sha256(resp.content).hexdigest(),
+            footer['hash'])
+
+        # Tampering with the URL invalidates the signature
+        resp = requests.get(asset['url'].replace(asset['hash'],
+            footer['hash']))
+        self.assertEqual(resp.status_code, 401)
+
+    def test_pull__scale(self):
+        """ Only the best density of each image is sent for a screen. """
+        app_id = 'test-app-for-pull-scale'
+        self._push_files(app_id, {'a.png': '1x', 'a@2x.png': '2x',
+                                  'a@3x.png': '3x', 'b.png': '1x',
+                                  'c.ios.png': '1x', 'c@2x.ios.png': '2x',
+                                  'c@3x.ios.png': '3x', 'index.js': 'js'})
+        pull_url = self._make_url('pull', app_id) + '&scale=2'
+        headers = {'content-type': 'application/json'}
+        resp = requests.post(pull_url, headers=headers, data=json.dumps({
+            'asset_hashes': {}
+        }))
+        self.assertEqual(resp.status_code, 200)
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            self.assertListEqual(sorted(zf.namelist()), [
+                '__siphon_assets/images/a@2x.png',
+                '__siphon_assets/images/b.png',
+                '__siphon_assets/images/c@2x.ios.png',
+                'assets-listing', 'bundle-footer'])
+            # Every variant is still listed
+            self.assertEqual(zf.read('assets-listing').decode().split(), [
+                'images/a.png', 'images/a@2x.png', 'images/a@3x.png',
+                'images/b.png', 'images/c.ios.png', 'images/c@2x.ios.png',
+                'images/c@3x.ios.png'])
+
+        resp = requests.post(self._make_url('pull', app_id) + '&scale=x',
+            headers=headers, data=json.dumps({'asset_hashes': {}}))
+        self.assertEqual(resp.status_code, 400)
+
+    def test_pull__platform_assets(self):
+        """ Other platforms' variants of an asset are left out. """
+        app_id = 'test-app-for-pull-platform-assets'
+        resp = post_archive_with_listing(self._make_url('push', app_id), {
+            'logo.ios.png': 'ios', 'logo.android.png': 'android',
+            'icon.png': 'icon', 'index.js': 'js',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        pull_url = self._make_url('pull', app_id) + '&platform=android'
+        headers = {'content-type': 'application/json'}
+        resp = requests.post(pull_url, headers=headers, data=json.dumps({
+            'asset_hashes': {}
+        }))
+        self.assertEqual(resp.status_code, 200)
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            listing = zf.read('assets-listing').decode().split()
+            self.assertListEqual(listing, [
+                'images/icon.png', 'images/logo.android.png'])
+            self.assertListEqual(sorted(zf.namelist()), [
+                '__siphon_assets/images/icon.png',
+                '__siphon_assets/images/logo.android.png',
+                'assets-listing', 'bundle-footer'])
+
+    def test_pull__platform_footers(self):
+        """ Each platform's footer is built from its own entry file. """
+        app_id = 'test-app-for-pull-platform-footers'
+        resp = post_archive_with_listing(self._make_url('push', app_id), {
+            'index.ios.js': 'ios-entry', 'index.android.js': 'android-entry',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        headers = {'content-type': 'application/json'}
+        for platform in ('ios', 'android'):
+            pull_url = self._make_url('pull', app_id) + \
+                '&platform=%s' % platform
+            resp = requests.post(pull_url, headers=headers, data=json.dumps({
+                'asset_hashes': {}
+            }))
+            self.assertEqual(resp.status_code, 200)
+            with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+                footer = zf.read('bundle-footer')
+                self.assertTrue(footer.endswith(
+                    ('%s-entry' % platform).encode()))
+
+    def test_pull__unknown_platform(self):
+        """ Only registered platforms can be pulled. """
+        app_id = 'test-app-for-pull-unknown-platform'
+        self._push_files(app_id, {'index.js': 'js'})
+        pull_url = self._make_url('pull', app_id) + '&platform=windows-phone'
+        headers = {'content-type': 'application/json'}
+        resp = requests.post(pull_url, headers=headers, data=json.dumps({
+            'asset_hashes': {}
+        }))
+        self.assertEqual(resp.status_code, 400)
+        self.assertTrue('Unknown platform.' in resp.content.decode('utf-8'))
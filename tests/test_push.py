@@ -1,9 +1,13 @@
 
 import requests
 import json
+import tarfile
+import zipfile
+from io import BytesIO
 
 from utils import BundlerTestCase, make_development_handshake
-from push_utils import get_hashes, post_archive, post_archive_with_listing
+from push_utils import get_hashes, post_archive, post_archive_with_listing, \
+    post_tarball_with_listing
 
 
 class TestPush(BundlerTestCase):
@@ -111,3 +115,349 @@ class TestPush(BundlerTestCase):
         }))
         self.assertEqual(resp.status_code, 200)
         self.assertTrue('Internal error.' not in str(resp.content))
+
+    def test_push__tarball(self):
+        """
+        A gzipped tarball (selected via Content-Type) should be accepted
+        in place of a zip archive.
+        """
+        app_id = 'test-push-tarball'
+        bundler_url = self._make_url(app_id)
+        resp = post_tarball_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        self.assertTrue('Internal error.' not in str(resp.content))
+        server_hashes = get_hashes(bundler_url)
+        self.assertEqual(len(server_hashes), 2)
+        self.assertTrue('index.ios.js' in server_hashes)
+
+    def test_push__tarball_old_regular_files(self):
+        """
+        Regular files written with the old '\\0' type flag are accepted too.
+        """
+        app_id = 'test-push-tarball-old-regular-files'
+        bundler_url = self._make_url(app_id)
+        resp = post_tarball_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }, tar_type=tarfile.AREGTYPE)
+        self.assertEqual(resp.status_code, 200)
+        self.assertTrue('Internal error.' not in str(resp.content))
+        server_hashes = get_hashes(bundler_url)
+        self.assertEqual(len(server_hashes), 2)
+
+    def test_push__tarball_security(self):
+        """ Tarballs get the same path checks as zip archives. """
+        app_id = 'test-push-with-bad-tarball'
+        bundler_url = self._make_url(app_id)
+        resp = post_tarball_with_listing(bundler_url, {
+            'valid-file': 'some-content',
+            '../bad-file': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertTrue('Internal error.' in str(resp.content))
+        server_hashes = get_hashes(bundler_url)
+        self.assertEqual(len(server_hashes), 0)
+
+    def test_push__dry_run(self):
+        """
+        A dry run should report what would change without storing anything.
+        """
+        app_id = 'test-push-dry-run'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url + '&dry_run=1', {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        s = resp.content.decode('utf-8')
+        self.assertTrue('Would add: index.ios.js' in s)
+        self.assertTrue('Dry run passed' in s)
+        server_hashes = get_hashes(bundler_url)
+        self.assertEqual(len(server_hashes), 0)
+
+    def test_push__dry_run_no_changes(self):
+        """ A dry run that would change nothing says so. """
+        app_id = 'test-push-dry-run-no-changes'
+        bundler_url = self._make_url(app_id)
+        files = {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }
+        resp = post_archive_with_listing(bundler_url, files)
+        self.assertEqual(resp.status_code, 200)
+        resp = post_archive_with_listing(bundler_url + '&dry_run=1', files)
+        self.assertEqual(resp.status_code, 200)
+        s = resp.content.decode('utf-8')
+        self.assertTrue('No changes detected.' in s)
+        self.assertTrue('Dry run passed' in s)
+
+    def test_push__dry_run_invalid_siphonfile(self):
+        """ Validation errors are reported rather than aborting a dry run. """
+        app_id = 'test-push-dry-run-invalid'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url + '&dry_run=1', {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": ""}'
+        })
+        s = resp.content.decode('utf-8')
+        self.assertTrue('[ERROR]' in s)
+        self.assertTrue('Would add: index.ios.js' in s)
+        self.assertTrue('Dry run failed' in s)
+
+    def test_push__ndjson_progress(self):
+        """
+        Clients that accept NDJSON get structured events and a final result.
+        """
+        app_id = 'test-push-ndjson'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }, headers={'Accept': 'application/x-ndjson'})
+        self.assertEqual(resp.status_code, 200)
+        self.assertEqual(resp.headers['Content-Type'], 'application/x-ndjson')
+        events = [json.loads(l) for l in resp.content.decode('utf-8').splitlines()]
+        self.assertEqual(events[0]['type'], 'phase')
+        self.assertTrue({'type': 'file', 'action': 'add',
+            'name': 'index.ios.js'} in events)
+        done = events[-1]
+        self.assertEqual(done['type'], 'done')
+        self.assertTrue(done['result']['success'])
+        self.assertListEqual(sorted(done['result']['added']),
+            ['Siphonfile', 'index.ios.js'])
+
+    def test_push__ndjson_error(self):
+        """ Fatal errors arrive as an error event followed by "done". """
+        app_id = 'test-push-ndjson-error'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": ""}'
+        }, headers={'Accept': 'application/x-ndjson'})
+        events = [json.loads(l) for l in resp.content.decode('utf-8').splitlines()]
+        self.assertEqual(events[-2]['type'], 'error')
+        self.assertTrue(events[-2]['fatal'])
+        self.assertEqual(events[-1]['type'], 'done')
+        self.assertFalse(events[-1]['result']['success'])
+
+    def test_push__revision_conflict(self):
+        """
+        A push based on a stale revision should be rejected with a list of
+        what changed since.
+        """
+        app_id = 'test-push-revision-conflict'
+        bundler_url = self._make_url(app_id)
+        resp = requests.get(bundler_url)
+        stale_revision = resp.json()['revision']
+        self.assertEqual(resp.headers['ETag'], '"%s"' % stale_revision)
+
+        # Somebody else pushes first
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }, headers={'If-Match': '"%s"' % stale_revision})
+        self.assertEqual(resp.status_code, 200)
+
+        # Then we push against the revision we fetched earlier
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'other-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }, headers={'If-Match': '"%s"' % stale_revision})
+        self.assertEqual(resp.status_code, 409)
+        s = resp.content.decode('utf-8')
+        self.assertTrue('added:   index.ios.js' in s)
+
+        # Pushing against the current revision is fine
+        revision = requests.get(bundler_url).json()['revision']
+        self.assertNotEqual(revision, stale_revision)
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'other-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }, headers={'If-Match': '"%s"' % revision})
+        self.assertEqual(resp.status_code, 200)
+
+    def test_push__ignored_files(self):
+        """
+        Files matched by the default ignore list or .siphonignore are never
+        stored, and are removed if they were stored before.
+        """
+        app_id = 'test-push-ignored-files'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'build/output.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        server_hashes = get_hashes(bundler_url)
+        self.assertTrue('build/output.js' in server_hashes)
+
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'build/output.js': 'some-content',
+            'node_modules/react/index.js': 'some-content',
+            '.DS_Store': 'some-content',
+            '.siphonignore': '# Build output\nbuild/\n',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        s = resp.content.decode('utf-8')
+        self.assertTrue('Ignored: node_modules/react/index.js' in s)
+        self.assertTrue('Ignored: .DS_Store' in s)
+        server_hashes = get_hashes(bundler_url)
+        self.assertListEqual(sorted(server_hashes.keys()),
+            ['.siphonignore', 'Siphonfile', 'index.ios.js'])
+
+    def test_push__symlink_rejected(self):
+        """ Symbolic links in the archive are rejected with a user error. """
+        app_id = 'test-push-with-symlink'
+        bundler_url = self._make_url(app_id)
+        fp = BytesIO()
+        with zipfile.ZipFile(fp, 'w') as zf:
+            info = zipfile.ZipInfo('diffs/passwd')
+            info.external_attr = 0o120777 << 16  # symlink
+            zf.writestr(info, '/etc/passwd')
+            zf.writestr('listing.json', json.dumps({'passwd': 'abc'}))
+        resp = requests.post(bundler_url, data=fp.getvalue())
+        s = resp.content.decode('utf-8')
+        self.assertTrue('[ERROR]' in s)
+        self.assertTrue('symbolic links are not allowed' in s)
+        server_hashes = get_hashes(bundler_url)
+        self.assertEqual(len(server_hashes), 0)
+
+    def test_push__absolute_path_rejected(self):
+        """ Absolute paths in the archive are rejected with a user error. """
+        app_id = 'test-push-with-absolute-path'
+        bundler_url = self._make_url(app_id)
+        fp = BytesIO()
+        with zipfile.ZipFile(fp, 'w') as zf:
+            zf.writestr('/diffs/index.ios.js', 'some-content')
+            zf.writestr('listing.json', json.dumps({'index.ios.js': 'abc'}))
+        resp = requests.post(bundler_url, data=fp.getvalue())
+        s = resp.content.decode('utf-8')
+        self.assertTrue('[ERROR]' in s)
+        self.assertTrue('absolute paths are not allowed' in s)
+        server_hashes = get_hashes(bundler_url)
+        self.assertEqual(len(server_hashes), 0)
+
+    def test_push__hash_only_rename(self):
+        """
+        Renamed or copied files don't need their content sent if we already
+        store a file with the same hash.
+        """
+        app_id = 'test-push-hash-only-rename'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url, {
+            'image.png': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        resp = post_archive_with_listing(bundler_url, {
+            'renamed.png': 'some-content',
+            'copied.png': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }, hash_only=['renamed.png', 'copied.png', 'Siphonfile'])
+        self.assertEqual(resp.status_code, 200)
+        self.assertTrue('Internal error.' not in str(resp.content))
+        server_hashes = get_hashes(bundler_url)
+        self.assertListEqual(sorted(server_hashes.keys()),
+            ['Siphonfile', 'copied.png', 'renamed.png'])
+
+    def test_push__hash_only_unknown_content(self):
+        """ Content can only be omitted if we already have the hash. """
+        app_id = 'test-push-hash-only-unknown'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url, {
+            'image.png': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }, hash_only=['image.png'])
+        self.assertTrue('Internal error.' in str(resp.content))
+        server_hashes = get_hashes(bundler_url)
+        self.assertEqual(len(server_hashes), 0)
+
+    def test_push__missing_blobs(self):
+        """ Only hashes the app doesn't store are reported as missing. """
+        app_id = 'test-push-missing-blobs'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url, {
+            'image.png': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        stored = get_hashes(bundler_url)['image.png']
+        missing_url = bundler_url.replace('/?', '/missing/?')
+        resp = requests.post(missing_url, data=json.dumps({
+            'hashes': [stored, 'abc123', 'abc123']
+        }))
+        self.assertEqual(resp.status_code, 200)
+        self.assertListEqual(resp.json()['missing'], ['abc123'])
+
+    def test_push__conditional_hashes(self):
+        """
+        GET returns a 304 if the client's ETag is current, and only the
+        changes if it asks for those since a known revision.
+        """
+        app_id = 'test-push-conditional-hashes'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url, {
+            'a.js': 'some-content',
+            'b.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        resp = requests.get(bundler_url)
+        etag = resp.headers['ETag']
+        revision = resp.json()['revision']
+
+        resp = requests.get(bundler_url, headers={'If-None-Match': etag})
+        self.assertEqual(resp.status_code, 304)
+
+        resp = post_archive_with_listing(bundler_url, {
+            'a.js': 'changed-content',
+            'c.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        resp = requests.get(bundler_url, headers={'If-None-Match': etag})
+        self.assertEqual(resp.status_code, 200)
+
+        resp = requests.get(bundler_url + '&since=' + revision)
+        obj = resp.json()
+        self.assertEqual(obj['since'], revision)
+        self.assertListEqual(sorted(obj['hashes'].keys()), ['a.js', 'c.js'])
+        self.assertListEqual(obj['removed'], ['b.js'])
+
+    def test_push__platform_counterparts(self):
+        """
+        Platform-specific files without a version for another declared
+        platform are reported.
+        """
+        app_id = 'test-push-platform-counterparts'
+        bundler_url = self._make_url(app_id)
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'index.android.js': 'some-content',
+            'Button.ios.js': 'some-content',
+            'Title.ios.js': 'some-content',
+            'Title.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        }, headers={'Accept': 'application/x-ndjson'})
+        self.assertEqual(resp.status_code, 200)
+        events = [json.loads(l) for l in resp.content.decode('utf-8').splitlines()]
+        result = events[-1]['result']
+        self.assertTrue(result['success'])
+        self.assertListEqual(result['warnings'], ['Button.ios.js has no '
+            'android counterpart (expected Button.android.js or Button.js).'])
+
+        # Not if the app is only built for iOS
+        resp = post_archive_with_listing(bundler_url, {
+            'index.ios.js': 'some-content',
+            'Button.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3", "platforms": ["ios"]}'
+        }, headers={'Accept': 'application/x-ndjson'})
+        events = [json.loads(l) for l in resp.content.decode('utf-8').splitlines()]
+        self.assertTrue(events[-1]['result']['success'])
+        self.assertFalse(events[-1]['result'].get('warnings'))
@@ -1,12 +1,13 @@
 
 import io
 import json
+import time
 import requests
 import zipfile
 
 from push_utils import get_hashes, post_archive
 from utils import BundlerTestCase, make_production_handshake, \
-    make_development_handshake, count_files
+    make_development_handshake, count_files, submit_and_wait
 
 APP_FILES_DEFAULT = 'test-data/push-files'
 APP_FILES_CHANGED = 'test-data/push-files-changed'
@@ -19,11 +20,14 @@ class TestSubmit(BundlerTestCase):
         return 'http://localhost:8000/v1/submit/%s/?handshake_token=%s' \
             '&handshake_signature=%s' % (app_id, token, signature)
 
-    def _push(self, app_id, app_files_dir, assert_no_files=True):
+    def _make_push_url(self, app_id):
         token, signature = make_development_handshake('push', 'testuser',
             app_id)
-        url = 'http://localhost:8000/v1/push/%s/?handshake_token=%s' \
+        return 'http://localhost:8000/v1/push/%s/?handshake_token=%s' \
             '&handshake_signature=%s' % (app_id, token, signature)
+
+    def _push(self, app_id, app_files_dir, assert_no_files=True):
+        url = self._make_push_url(app_id)
         server_hashes = get_hashes(url)
         self.assertTrue(isinstance(server_hashes, dict))
         if assert_no_files:
@@ -35,12 +39,12 @@ class TestSubmit(BundlerTestCase):
         self.assertTrue(isinstance(server_hashes, dict))
         self.assertEqual(len(server_hashes), count_files(app_files_dir))
 
-    def _pull_submission(self, submission_id, app_id):
+    def _pull_submission(self, submission_id, app_id, platform='ios'):
         token, signature = make_production_handshake('pull', submission_id,
             app_id)
         pull_url = 'http://localhost:8000/v1/pull/%s/?handshake_token=%s' \
-            '&handshake_signature=%s&submission_id=%s' % (
-            app_id, token, signature, submission_id)
+            '&handshake_signature=%s&submission_id=%s&platform=%s' % (
+            app_id, token, signature, submission_id, platform)
 
         headers = {'content-type': 'application/json'}
         return requests.post(pull_url, headers=headers, data=json.dumps({
@@ -68,8 +72,8 @@ class TestSubmit(BundlerTestCase):
 
         # Then make the submission snapshot
         url = self._make_submit_url(submission_id, app_id)
-        resp = requests.post(url, data={'submission_id': submission_id})
-        self.assertEqual(resp.status_code, 200)
+        job = submit_and_wait(url, {'submission_id': submission_id})
+        self.assertEqual(job['status'], 'succeeded')
 
         # Do a production pull to check that the submit was OK.
         self._check_submission(submission_id, app_id)
@@ -87,8 +91,8 @@ class TestSubmit(BundlerTestCase):
 
         # Then make the submission snapshot
         url = self._make_submit_url(submission_id, app_id)
-        resp = requests.post(url, data={'submission_id': submission_id})
-        self.assertEqual(resp.status_code, 200)
+        job = submit_and_wait(url, {'submission_id': submission_id})
+        self.assertEqual(job['status'], 'succeeded')
 
         # Get the .zip content for the submission
         resp = self._pull_submission(submission_id, app_id)
@@ -128,8 +132,8 @@ class TestSubmit(BundlerTestCase):
 
         # Then make the submission snapshot
         url = self._make_submit_url(submission_id, app_id)
-        resp = requests.post(url, data={'submission_id': submission_id})
-        self.assertEqual(resp.status_code, 200)
+        job = submit_and_wait(url, {'submission_id': submission_id})
+        self.assertEqual(job['status'], 'succeeded')
 
         # Then try to make another one with the same submission_id,
         # it should fail
@@ -138,3 +142,138 @@ class TestSubmit(BundlerTestCase):
         s = resp.content.decode('utf-8')
         self.assertEqual(resp.status_code, 400)
         self.assertTrue('Submission ID already exists.' in s)
+
+    def test_submit__unknown_platform(self):
+        """ Only registered platforms can be submitted. """
+        app_id = 'submit-app-id-unknown-platform'
+        submission_id = 'submit-id-unknown-platform'
+        self._push(app_id, APP_FILES_DEFAULT)
+        url = self._make_submit_url(submission_id, app_id)
+        resp = requests.post(url, data={'submission_id': submission_id,
+                                        'platform': 'windows-phone'})
+        self.assertEqual(resp.status_code, 400)
+        self.assertTrue('Unknown platform.' in resp.content.decode('utf-8'))
+
+    def test_submit__all_platforms(self):
+        """ A submission has a footer for every platform. """
+        app_id = 'submit-app-id-all-platforms'
+        submission_id = 'submit-id-all-platforms'
+        self._push(app_id, APP_FILES_DEFAULT)
+        resp = submit_and_wait(self._make_submit_url(submission_id, app_id),
+            {'submission_id': submission_id})
+        self.assertEqual(resp['status'], 'succeeded')
+        for platform in ('ios', 'android'):
+            resp = self._pull_submission(submission_id, app_id, platform)
+            self.assertEqual(resp.status_code, 200)
+            with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+                self.assertTrue('bundle-footer' in zf.namelist())
+
+    def test_submit__revision(self):
+        """ A revision that has since been pushed over can be submitted. """
+        app_id = 'submit-app-id-revision'
+        submission_id = 'submit-id-revision'
+        self._push(app_id, APP_FILES_DEFAULT)
+        resp = requests.get(self._make_push_url(app_id))
+        revision = resp.headers['ETag']
+        tested = resp.json()['hashes']
+        self._push(app_id, APP_FILES_CHANGED, assert_no_files=False)
+
+        url = self._make_submit_url(submission_id, app_id)
+        job = submit_and_wait(url, {'submission_id': submission_id,
+                                    'revision': revision})
+        self.assertEqual(job['status'], 'succeeded')
+        self.assertEqual(job['revision'], revision.strip('"'))
+        self._check_submission(submission_id, app_id)
+
+        # The submission has exactly the files we tested, not the new ones
+        token, signature = make_production_handshake('clone', submission_id,
+            app_id)
+        resp = requests.get('http://localhost:8000/v1/clone/%s/?'
+            'handshake_token=%s&handshake_signature=%s&submission_id=%s' % (
+            app_id, token, signature, submission_id))
+        self.assertEqual(resp.status_code, 200)
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            self.assertListEqual(sorted(zf.namelist()), sorted(tested.keys()))
+
+        # Unknown revisions are rejected up front
+        url = self._make_submit_url('submit-id-revision-unknown', app_id)
+        resp = requests.post(url, data={
+            'submission_id': 'submit-id-revision-unknown',
+            'revision': 'a' * 64})
+        self.assertEqual(resp.status_code, 400)
+        self.assertTrue('Unknown revision.' in resp.content.decode('utf-8'))
+
+    def test_submit__manifest(self):
+        """ An explicit manifest must only refer to content we store. """
+        app_id = 'submit-app-id-manifest'
+        submission_id = 'submit-id-manifest'
+        self._push(app_id, APP_FILES_DEFAULT)
+        hashes = get_hashes(self._make_push_url(app_id))
+        manifest = {'Siphonfile': hashes['Siphonfile'],
+                    'index.ios.js': hashes['index.ios.js'],
+                    'copy-of-index.ios.js': hashes['index.ios.js']}
+
+        # Content we don't have can't be submitted
+        bad = dict(manifest, **{'missing.js': 'b' * 64})
+        url = self._make_submit_url(submission_id, app_id)
+        resp = requests.post(url, data={'submission_id': submission_id,
+                                        'manifest': json.dumps(bad)})
+        self.assertEqual(resp.status_code, 400)
+        self.assertTrue('Files are no longer stored: missing.js' in
+            resp.content.decode('utf-8'))
+
+        resp = requests.post(url, data={'submission_id': submission_id,
+                                        'manifest': '[1, 2, 3]'})
+        self.assertEqual(resp.status_code, 400)
+
+        # Names have to be safe paths within the app
+        for name in ('/etc/passwd', '..', 'a/../../b.js', ''):
+            bad = dict(manifest, **{name: hashes['index.ios.js']})
+            resp = requests.post(url, data={'submission_id': submission_id,
+                                            'manifest': json.dumps(bad)})
+            self.assertEqual(resp.status_code, 400)
+            self.assertTrue('Bad manifest name' in
+                resp.content.decode('utf-8'))
+
+        job = submit_and_wait(url, {'submission_id': submission_id,
+                                    'manifest': json.dumps(manifest)})
+        self.assertEqual(job['status'], 'succeeded')
+        resp = self._pull_submission(submission_id, app_id)
+        self.assertEqual(resp.status_code, 200)
+        with zipfile.ZipFile(io.BytesIO(resp.content)) as zf:
+            self.assertListEqual(zf.namelist(),
+                ['assets-listing', 'bundle-footer'])
+
+    def test_submit__job_status(self):
+        """ Submits are queued as jobs whose status can be polled. """
+        app_id = 'submit-app-id-job-status'
+        submission_id = 'submit-id-job-status'
+        self._push(app_id, APP_FILES_DEFAULT)
+        url = self._make_submit_url(submission_id, app_id)
+        resp = requests.post(url, data={'submission_id': submission_id})
+        self.assertEqual(resp.status_code, 202)
+        job = resp.json()
+        self.assertTrue(job['status'] in ('queued', 'running', 'succeeded'))
+        self.assertEqual(job['submission_id'], submission_id)
+
+        # The submission ID is taken as soon as the job is queued
+        again = requests.post(url, data={'submission_id': submission_id})
+        self.assertEqual(again.status_code, 400)
+
+        query = url.split('?', 1)[1]
+        status_url = 'http://localhost:8000/v1/submit/%s/jobs/%d/?%s' % (
+            app_id, resp.json()['id'], query)
+        for i in range(60):
+            job = requests.get(status_url).json()
+            if job['status'] == 'succeeded':
+                break
+            time.sleep(0.5)
+        self.assertEqual(job['status'], 'succeeded')
+        self.assertEqual(job['progress'], 100)
+        self.assertEqual(job['error'], '')
+
+        # Only the submission's own handshake can see the job
+        other_url = self._make_submit_url('some-other-submission', app_id)
+        resp = requests.get('http://localhost:8000/v1/submit/%s/jobs/%d/?%s'
+            % (app_id, job['id'], other_url.split('?', 1)[1]))
+        self.assertEqual(resp.status_code, 404)
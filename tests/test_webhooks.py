@@ -0,0 +1,119 @@
+import hashlib
+import hmac
+import json
+import threading
+import time
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+import requests
+
+from utils import BundlerTestCase, make_development_handshake
+from push_utils import post_archive_with_listing
+
+SECRET = 'a-very-secret-webhook-key'
+
+
+class WebhookReceiver(BaseHTTPRequestHandler):
+    received = []
+
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers['Content-Length']))
+        WebhookReceiver.received.append((dict(self.headers), body))
+        self.send_response(200)
+        self.end_headers()
+
+    def log_message(self, *args):
+        pass
+
+
+class TestWebhooks(BundlerTestCase):
+    @classmethod
+    def setUpClass(cls):
+        super(TestWebhooks, cls).setUpClass()
+        cls._server = HTTPServer(('127.0.0.1', 0), WebhookReceiver)
+        cls._thread = threading.Thread(target=cls._server.serve_forever)
+        cls._thread.daemon = True
+        cls._thread.start()
+
+    @classmethod
+    def tearDownClass(cls):
+        cls._server.shutdown()
+        super(TestWebhooks, cls).tearDownClass()
+
+    def setUp(self):
+        WebhookReceiver.received = []
+
+    def _make_url(self, action, app_id, path=''):
+        token, signature = make_development_handshake(action, 'testuser',
+            app_id)
+        return 'http://localhost:8000/v1/%s/%s/%s?handshake_token=%s' \
+            '&handshake_signature=%s' % (action, app_id, path, token,
+            signature)
+
+    def _subscribe(self, app_id):
+        resp = requests.post(self._make_url('webhooks', app_id),
+            data=json.dumps({
+                'url': 'http://127.0.0.1:%d/hook' % self._server.server_port,
+                'secret': SECRET
+            }))
+        self.assertEqual(resp.status_code, 201)
+        return resp.json()
+
+    def _wait_for_delivery(self, n=1):
+        for _ in range(50):
+            if len(WebhookReceiver.received) >= n:
+                return
+            time.sleep(0.1)
+        self.fail('Webhook was not delivered.')
+
+    def _check_signature(self, headers, body):
+        # The signature covers the timestamp, so it can't be replayed later
+        timestamp = headers['X-Siphon-Timestamp']
+        self.assertTrue(abs(int(timestamp) - time.time()) < 60)
+        signed = timestamp.encode('utf-8') + b'.' + body
+        expected = 'sha256=' + hmac.new(SECRET.encode('utf-8'), signed,
+            hashlib.sha256).hexdigest()
+        self.assertEqual(headers['X-Siphon-Signature'], expected)
+
+    def test_webhook__push(self):
+        app_id = 'test-webhook-push'
+        hook = self._subscribe(app_id)
+        self.assertTrue('secret' not in hook)
+        resp = post_archive_with_listing(self._make_url('push', app_id), {
+            'index.ios.js': 'some-content',
+            'Siphonfile': '{"base_version": "0.3"}'
+        })
+        self.assertEqual(resp.status_code, 200)
+        self._wait_for_delivery()
+        headers, body = WebhookReceiver.received[0]
+        self._check_signature(headers, body)
+        payload = json.loads(body.decode('utf-8'))
+        self.assertEqual(payload['event'], 'push')
+        self.assertEqual(payload['app_id'], app_id)
+        self.assertListEqual(sorted(payload['data']['added']),
+            ['Siphonfile', 'index.ios.js'])
+
+    def test_webhook__test_delivery_and_log(self):
+        app_id = 'test-webhook-test-delivery'
+        hook = self._subscribe(app_id)
+        resp = requests.post(self._make_url('webhooks', app_id,
+            '%d/test/' % hook['id']))
+        self.assertEqual(resp.status_code, 200)
+        self.assertTrue(resp.json()['success'])
+        self.assertEqual(len(WebhookReceiver.received), 1)
+        headers, body = WebhookReceiver.received[0]
+        self._check_signature(headers, body)
+        self.assertEqual(headers['X-Siphon-Event'], 'test')
+
+        resp = requests.get(self._make_url('webhooks', app_id,
+            '%d/deliveries/' % hook['id']))
+        self.assertEqual(resp.status_code, 200)
+        deliveries = resp.json()
+        self.assertEqual(len(deliveries), 1)
+        self.assertEqual(deliveries[0]['event'], 'test')
+        self.assertEqual(deliveries[0]['status_code'], 200)
+
+    def test_webhook__invalid_url(self):
+        resp = requests.post(self._make_url('webhooks', 'test-webhook-bad'),
+            data=json.dumps({'url': 'ftp://example.com', 'secret': SECRET}))
+        self.assertEqual(resp.status_code, 400)
@@ -6,6 +6,7 @@ import signal
 import time
 import os
 import unittest
+import requests
 import subprocess
 from urllib.parse import quote
 
@@ -64,15 +65,35 @@ def make_development_handshake(action, user_id, app_id):
         'app_id': app_id
     })
 
-def make_production_handshake(action, submission_id, app_id):
-    return make_handshake({
+def make_production_handshake(action, submission_id, app_id, user_id=None):
+    obj = {
         'action': action,
         'submission_id': submission_id,
         'app_id': app_id
-    })
+    }
+    if user_id:
+        obj['user_id'] = user_id
+    return make_handshake(obj)
 
 def count_files(path):
     n = 0
     for a, b, c in os.walk(path):
         n += len(c)
     return n
+
+def submit_and_wait(url, data, timeout=60):
+    """
+    Queues a submit job and polls it until it finishes, returning the job
+    (or the response, if the submit was rejected outright).
+    """
+    resp = requests.post(url, data=data)
+    if resp.status_code != 202:
+        return resp
+    job = resp.json()
+    query = url.split('?', 1)[1]
+    status_url = 'http://localhost:8000%s?%s' % (job['status_url'], query)
+    deadline = time.time() + timeout
+    while job['status'] in ('queued', 'running') and time.time() < deadline:
+        time.sleep(0.5)
+        job = requests.get(status_url).json()
+    return job